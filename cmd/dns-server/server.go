@@ -3,15 +3,38 @@ package dns_server
 import (
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
-	"golang.org/x/net/dns/dnsmessage"
 	"net"
+	"os"
 	recursive_dns_resolver "resolver/cmd/recursive-dns-resolver"
 	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	// defaultMaxUdpPayload avoids IP fragmentation, as recommended by DNS flag day 2020
+	defaultMaxUdpPayload = 1232
+	// minUdpPayload is what every client has to accept, and all clients without EDNS get
+	minUdpPayload = 512
+)
+
+var maxUdpPayload uint16 = defaultMaxUdpPayload
+
+func loadMaxUdpPayload() uint16 {
+	if v, ok := os.LookupEnv("DNS_MAX_UDP_PAYLOAD"); ok {
+		n, err := strconv.ParseUint(v, 10, 16)
+		if err == nil && n >= minUdpPayload {
+			return uint16(n)
+		}
+		zap.S().Warnf("Invalid DNS_MAX_UDP_PAYLOAD %q", v)
+	}
+	return defaultMaxUdpPayload
+}
+
 func Start(bindIp net.IP) {
+	maxUdpPayload = loadMaxUdpPayload()
+	go startTCP(bindIp)
+
 	addr := net.UDPAddr{
 		Port: 53,
 		IP:   bindIp,
@@ -22,22 +45,27 @@ func Start(bindIp net.IP) {
 	}
 	defer conn.Close()
 
-	var buf [1024]byte
+	buf := make([]byte, dns.MaxMsgSize)
 	for {
 		var rlen int
 		var remote *net.UDPAddr
-		rlen, remote, err = conn.ReadFromUDP(buf[:])
+		rlen, remote, err = conn.ReadFromUDP(buf)
 		if err != nil {
 			panic(err)
 		}
-		go dnsHandler(buf[:rlen], remote, conn)
+		// The buffer is reused for the next datagram while this one is handled
+		query := make([]byte, rlen)
+		copy(query, buf[:rlen])
+		go dnsHandler(query, remote, conn)
 	}
 
 }
 
 func dnsHandler(buf []byte, remote *net.UDPAddr, conn *net.UDPConn) {
-	response := parseAndQuery(buf, remote)
+	response, udpSize := parseAndQuery(buf, remote)
 	if response != nil {
+		// Truncate drops what does not fit and sets the TC bit, so the client retries over TCP
+		response.Truncate(udpSize)
 		var packed []byte
 		var err error
 		packed, err = response.Pack()
@@ -52,165 +80,125 @@ func dnsHandler(buf []byte, remote *net.UDPAddr, conn *net.UDPConn) {
 	}
 }
 
-func parseAndQuery(buf []byte, remote *net.UDPAddr) *dnsmessage.Message {
+// parseAndQuery answers the query in buf.
+// It returns the response and the size a UDP response to the client may have.
+func parseAndQuery(buf []byte, remote net.Addr) (*dns.Msg, int) {
 	now := time.Now()
 	err := dns.IsMsg(buf)
 	if err != nil {
 		zap.S().Errorf("Received invalid DNS message from %s (%s)", remote.String(), err)
-		return nil
+		return nil, 0
 	}
 
-	var m dnsmessage.Message
+	var m dns.Msg
 	err = m.Unpack(buf)
 	if err != nil {
 		zap.S().Errorf("Failed to unpack DNS message from %s (%s)", remote.String(), err)
-		return nil
+		return nil, 0
 	}
 
-	var r dnsmessage.Message
+	var r dns.Msg
 	r.Response = true
-	r.ID = m.ID
-	r.Questions = m.Questions
+	r.Id = m.Id
+	r.Opcode = m.Opcode
+	r.Question = m.Question
+	r.RecursionDesired = m.RecursionDesired
+	r.RecursionAvailable = true
 	r.Authoritative = true
-	r.RCode = dnsmessage.RCodeServerFailure
+	r.Compress = true
+	r.Rcode = dns.RcodeServerFailure
+
+	udpSize := minUdpPayload
+	opt := m.IsEdns0()
+	if opt != nil {
+		if int(opt.UDPSize()) > udpSize {
+			udpSize = int(opt.UDPSize())
+		}
+		if udpSize > int(maxUdpPayload) {
+			udpSize = int(maxUdpPayload)
+		}
+		// Responses to EDNS queries carry an OPT record, advertising our own limit and echoing the DO bit
+		r.SetEdns0(maxUdpPayload, opt.Do())
+		if opt.Version() != 0 {
+			zap.S().Warnf("Received EDNS version %d from %s", opt.Version(), remote.String())
+			r.Rcode = dns.RcodeBadVers
+			return &r, udpSize
+		}
+	}
 
 	if m.Response {
 		zap.S().Errorf("Received response from %s", remote.String())
-		r.RCode = dnsmessage.RCodeRefused
-		return &r
+		r.Rcode = dns.RcodeRefused
+		return &r, udpSize
 	}
-	if m.OpCode != 0 {
+	if m.Opcode != dns.OpcodeQuery {
 		zap.S().Errorf("Received non-query from %s", remote.String())
-		r.RCode = dnsmessage.RCodeRefused
-		return &r
+		r.Rcode = dns.RcodeRefused
+		return &r, udpSize
 	}
-	if len(m.Questions) != 1 {
+	if len(m.Question) != 1 {
 		zap.S().Errorf("Received non-question from %s", remote.String())
-		r.RCode = dnsmessage.RCodeRefused
-		return &r
+		r.Rcode = dns.RcodeRefused
+		return &r, udpSize
 	}
-	q := m.Questions[0]
+	q := m.Question[0]
 
-	if strings.Contains(q.Name.String(), "in-addr.arpa") {
-		zap.S().Errorf("Received reverse DNS query from %s", remote.String())
-		r.RCode = dnsmessage.RCodeNotImplemented
-		return &r
-	}
-	if strings.Contains(q.Name.String(), ".fritz.box") {
+	if strings.Contains(q.Name, ".fritz.box") {
 		zap.S().Errorf("Received query for wierd frizt.box subdomain %s", remote.String())
-		r.RCode = dnsmessage.RCodeRefused
-		return &r
+		r.Rcode = dns.RcodeRefused
+		return &r, udpSize
 	}
 
 	zap.S().Debugf("Received query for %s from %s", q.Name, remote.String())
 
-	var domainV4 []string
-	var domainV6 []string
-	if q.Type == dnsmessage.TypeA {
-		domainV4, err = recursive_dns_resolver.ResolveDomain(q.Name.String(), false, false)
-		if err != nil {
-			zap.S().Warnf("Failed to resolve domain %s (%s)", q.Name.String(), err)
-			r.RCode = dnsmessage.RCodeNameError
-			return &r
-		}
-	} else if q.Type == dnsmessage.TypeAAAA {
-		domainV6, err = recursive_dns_resolver.ResolveDomain(q.Name.String(), true, false)
-		if err != nil {
-			zap.S().Warnf("Failed to resolve domain %s (%s)", q.Name.String(), err)
-			r.RCode = dnsmessage.RCodeNameError
-			return &r
-		}
-	} else {
-		zap.S().Warnf("Received query for unknown type %d from %s", q.Type, remote.String())
-		r.RCode = dnsmessage.RCodeNotImplemented
-		return &r
+	if q.Qclass != dns.ClassINET {
+		zap.S().Warnf("Received query for class %d from %s", q.Qclass, remote.String())
+		r.Rcode = dns.RcodeNotImplemented
+		return &r, udpSize
+	}
+	switch q.Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG, dns.TypeTKEY:
+		zap.S().Warnf("Received query for meta type %d from %s", q.Qtype, remote.String())
+		r.Rcode = dns.RcodeNotImplemented
+		return &r, udpSize
 	}
 
-	zap.S().Infof("Resolved domain %s to %s & %s in %v", q.Name.String(), domainV4, domainV6, time.Since(now))
+	result, err := recursive_dns_resolver.Resolve(q, recursive_dns_resolver.Options{CheckingDisabled: m.CheckingDisabled})
+	if err != nil {
+		// Failing to resolve says nothing about whether the domain exists
+		zap.S().Warnf("Failed to resolve domain %s (%s)", q.Name, err)
+		r.Rcode = dns.RcodeServerFailure
+		return &r, udpSize
+	}
 
-	var res []dnsmessage.Resource
-	for _, s := range domainV4 {
-		ip := net.ParseIP(s)
-		if ip == nil {
-			continue
-		}
-		splits := strings.Split(s, ".")
-		if len(splits) != 4 {
-			continue
-		}
+	zap.S().Infof("Resolved domain %s %s to %d records via %d CNAMEs (%s, secure: %t) in %v", q.Name, dns.TypeToString[q.Qtype], len(result.Answer), len(result.CnameChain), dns.RcodeToString[result.Rcode], result.Secure, time.Since(now))
 
-		a, _ := strconv.Atoi(splits[0])
-		b, _ := strconv.Atoi(splits[1])
-		c, _ := strconv.Atoi(splits[2])
-		d, _ := strconv.Atoi(splits[3])
-
-		res = append(
-			res, dnsmessage.Resource{
-				Header: dnsmessage.ResourceHeader{
-					Name:  q.Name,
-					Type:  q.Type,
-					Class: q.Class,
-				},
-				Body: &dnsmessage.AResource{
-					A: [4]byte{byte(a), byte(b), byte(c), byte(d)},
-				},
-			})
-	}
-
-	for _, s := range domainV6 {
-		ip := net.ParseIP(s)
-		if ip == nil {
-			continue
-		}
-		// Normalize IPv6, adding 0000, until 8 segments
-		//2a00:1450:400e:811::200e
-
-		if strings.Contains(s, "::") {
-			s = strings.Replace(s, "::", ":0000:", 1)
-			for {
-				if len(strings.Split(s, ":")) == 8 {
-					break
-				}
-				s = strings.Replace(s, ":0000:", ":0000:0000:", 1)
-			}
-		}
-
-		splits := strings.Split(s, ":")
-		if len(splits) != 8 {
-			zap.S().Errorf("Invalid IPv6 address %s (got %d splits)", s, len(splits))
-			continue
-		}
+	// The CNAME chain comes first, so clients can follow it to the records
+	res := make([]dns.RR, 0, len(result.CnameChain)+len(result.Answer))
+	for _, rr := range result.CnameChain {
+		res = append(res, rr)
+	}
+	res = append(res, result.Answer...)
 
-		var bx [16]byte
-		var n int
-		for _, split := range splits {
-			if len(split) != 4 {
-				split = strings.Repeat("0", 4-len(split)) + split
+	// DNSSEC records are only sent to clients asking for them with the DO bit
+	do := opt != nil && opt.Do()
+	if do {
+		res = append(res, result.Signatures...)
+	}
+	r.Answer = res
+	// Negative answers carry the SOA, telling clients how long to cache them
+	for _, rr := range result.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if !do {
+				continue
 			}
-			a := split[:2]
-			b := split[2:]
-			ix, _ := strconv.ParseUint(a, 16, 8)
-			jx, _ := strconv.ParseUint(b, 16, 8)
-			bx[n] = byte(ix)
-			n++
-			bx[n] = byte(jx)
-			n++
 		}
-
-		res = append(
-			res, dnsmessage.Resource{
-				Header: dnsmessage.ResourceHeader{
-					Name:  q.Name,
-					Type:  q.Type,
-					Class: q.Class,
-				},
-				Body: &dnsmessage.AAAAResource{
-					AAAA: bx,
-				},
-			})
-	}
-
-	r.Answers = res
-	r.RCode = dnsmessage.RCodeSuccess
-	return &r
+		r.Ns = append(r.Ns, rr)
+	}
+	r.Rcode = result.Rcode
+	// Only clients that understand it get the AD bit, as of RFC 6840
+	r.AuthenticatedData = result.Secure && (m.AuthenticatedData || do)
+	r.CheckingDisabled = m.CheckingDisabled
+	return &r, udpSize
 }
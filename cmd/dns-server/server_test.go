@@ -0,0 +1,198 @@
+package dns_server
+
+import (
+	"encoding/binary"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"os"
+	"path"
+	recursive_dns_resolver "resolver/cmd/recursive-dns-resolver"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testRemote = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+
+func packQuery(t *testing.T, m *dns.Msg) []byte {
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestEdnsResponse(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Opcode = dns.OpcodeStatus
+	m.SetEdns0(4096, true)
+
+	r, udpSize := parseAndQuery(packQuery(t, m), testRemote)
+	if r == nil {
+		t.Fatal("no response")
+	}
+	if udpSize != defaultMaxUdpPayload {
+		t.Fatalf("client payload not capped, got %d", udpSize)
+	}
+	opt := r.IsEdns0()
+	if opt == nil || !opt.Do() || opt.UDPSize() != defaultMaxUdpPayload {
+		t.Fatalf("unexpected OPT in response %v", opt)
+	}
+
+	// Clients without EDNS are limited to 512 bytes
+	m = new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Opcode = dns.OpcodeStatus
+	r, udpSize = parseAndQuery(packQuery(t, m), testRemote)
+	if udpSize != minUdpPayload || r.IsEdns0() != nil {
+		t.Fatalf("unexpected EDNS handling for plain query (%d)", udpSize)
+	}
+}
+
+func TestEdnsBadVersion(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	m.IsEdns0().SetVersion(1)
+
+	r, _ := parseAndQuery(packQuery(t, m), testRemote)
+	buf, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unpacked dns.Msg
+	if err = unpacked.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if unpacked.Rcode != dns.RcodeBadVers || unpacked.IsEdns0() == nil {
+		t.Fatalf("expected BADVERS with OPT, got %s", dns.RcodeToString[unpacked.Rcode])
+	}
+}
+
+func TestMetaTypesNotImplemented(t *testing.T) {
+	for _, qtype := range []uint16{dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILB} {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", qtype)
+		r, _ := parseAndQuery(packQuery(t, m), testRemote)
+		if r == nil || r.Rcode != dns.RcodeNotImplemented {
+			t.Fatalf("expected NOTIMP for %s", dns.TypeToString[qtype])
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	r, _ := parseAndQuery(packQuery(t, m), testRemote)
+	if r == nil || r.Rcode != dns.RcodeNotImplemented {
+		t.Fatal("expected NOTIMP for CHAOS class")
+	}
+}
+
+// cacheLargeAnswer puts a TXT RRset of about 3 KB for name into the resolver cache, so it is answered without network
+func cacheLargeAnswer(t *testing.T, name string) int {
+	var answer []string
+	for i := 0; i < 30; i++ {
+		answer = append(answer, fmt.Sprintf("%s 3600 IN TXT \"%d %s\"", name, i, strings.Repeat("x", 100)))
+	}
+	now := time.Now()
+	snapshot := []map[string]interface{}{{
+		"name":    name,
+		"qtype":   dns.TypeTXT,
+		"qclass":  dns.ClassINET,
+		"stored":  now,
+		"expires": now.Add(time.Hour),
+		"rcode":   dns.RcodeSuccess,
+		"answer":  answer,
+	}}
+	data, err := jsoniter.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := path.Join(t.TempDir(), "dns-cache.json")
+	if err = os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DNS_CACHE_SNAPSHOT", p)
+	if err = recursive_dns_resolver.LoadCacheSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	return len(answer)
+}
+
+func TestTruncation(t *testing.T) {
+	records := cacheLargeAnswer(t, "large.test.")
+	m := new(dns.Msg)
+	m.SetQuestion("large.test.", dns.TypeTXT)
+	m.SetEdns0(1232, false)
+	query := packQuery(t, m)
+
+	// Over UDP the answer does not fit, so it is truncated to the payload size of the client
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	dnsHandler(query, client.LocalAddr().(*net.UDPAddr), server)
+
+	buf := make([]byte, 65535)
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > 1232 {
+		t.Fatalf("UDP response of %d bytes exceeds the payload size of the client", n)
+	}
+	var r dns.Msg
+	if err = r.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Truncated || r.Id != m.Id || len(r.Answer) >= records {
+		t.Fatalf("expected truncated response, got TC %t with %d records", r.Truncated, len(r.Answer))
+	}
+
+	// Over TCP the same answer is sent completely
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.AcceptTCP()
+		if err == nil {
+			handleTCPConn(conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write(append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)); err != nil {
+		t.Fatal(err)
+	}
+	var length [2]byte
+	if _, err = io.ReadFull(conn, length[:]); err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if r.Truncated || len(r.Answer) != records {
+		t.Fatalf("expected complete TCP response, got TC %t with %d records", r.Truncated, len(r.Answer))
+	}
+}
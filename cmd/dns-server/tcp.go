@@ -0,0 +1,127 @@
+package dns_server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// tcpIdleTimeout closes connections without new queries, RFC 7766 recommends timeouts in the order of seconds
+	tcpIdleTimeout  = 10 * time.Second
+	tcpWriteTimeout = 10 * time.Second
+	// tcpMaxPipelined limits the queries of a single connection resolved at the same time
+	tcpMaxPipelined          = 32
+	tcpDefaultMaxConnections = 256
+)
+
+func tcpMaxConnections() int {
+	if v, ok := os.LookupEnv("DNS_TCP_MAX_CONNECTIONS"); ok {
+		n, err := strconv.Atoi(v)
+		if err == nil && n > 0 {
+			return n
+		}
+		zap.S().Warnf("Invalid DNS_TCP_MAX_CONNECTIONS %q", v)
+	}
+	return tcpDefaultMaxConnections
+}
+
+// startTCP serves DNS over TCP as described by RFC 7766.
+// Queries are length prefixed and may be pipelined, their responses are sent as soon as they are resolved,
+// possibly out of order.
+func startTCP(bindIp net.IP) {
+	addr := net.TCPAddr{
+		Port: 53,
+		IP:   bindIp,
+	}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		panic(err)
+	}
+	defer listener.Close()
+
+	slots := make(chan struct{}, tcpMaxConnections())
+	for {
+		var conn *net.TCPConn
+		conn, err = listener.AcceptTCP()
+		if err != nil {
+			zap.S().Errorf("Failed to accept DNS TCP connection (%s)", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+			go func() {
+				defer func() { <-slots }()
+				handleTCPConn(conn)
+			}()
+		default:
+			zap.S().Warnf("Too many DNS TCP connections, rejecting %s", conn.RemoteAddr().String())
+			_ = conn.Close()
+		}
+	}
+}
+
+func handleTCPConn(conn *net.TCPConn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr()
+	reader := bufio.NewReader(conn)
+
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	pipelined := make(chan struct{}, tcpMaxPipelined)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		var length [2]byte
+		_, err := io.ReadFull(reader, length[:])
+		if err != nil {
+			if err != io.EOF {
+				zap.S().Debugf("Closing DNS TCP connection from %s (%s)", remote.String(), err)
+			}
+			break
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err = io.ReadFull(reader, buf)
+		if err != nil {
+			zap.S().Debugf("Failed to read DNS message from %s (%s)", remote.String(), err)
+			break
+		}
+
+		pipelined <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-pipelined }()
+
+			// Over TCP the whole response is sent, regardless of the EDNS payload size
+			response, _ := parseAndQuery(buf, remote)
+			if response == nil {
+				return
+			}
+			packed, err := response.Pack()
+			if err != nil {
+				zap.S().Errorf("Failed to pack DNS response (%s)", err)
+				return
+			}
+			message := make([]byte, 2+len(packed))
+			binary.BigEndian.PutUint16(message, uint16(len(packed)))
+			copy(message[2:], packed)
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			_ = conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+			_, err = conn.Write(message)
+			if err != nil {
+				zap.S().Errorf("Failed to send response to %s (%s)", remote.String(), err)
+			}
+		}()
+	}
+	// Queries already read are still answered before the connection is closed
+	wg.Wait()
+}
@@ -0,0 +1,74 @@
+package dns_server
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPPipelining(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.AcceptTCP()
+		if err == nil {
+			handleTCPConn(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Status queries are refused without touching the resolver, so no network is needed
+	var pipelined []byte
+	ids := map[uint16]bool{}
+	for i := 0; i < 3; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.Opcode = dns.OpcodeStatus
+		ids[m.Id] = true
+		packed, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipelined = append(pipelined, byte(len(packed)>>8), byte(len(packed)))
+		pipelined = append(pipelined, packed...)
+	}
+	// Queries may arrive split across segments
+	if _, err = conn.Write(pipelined[:7]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err = conn.Write(pipelined[7:]); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		var length [2]byte
+		if _, err = io.ReadFull(conn, length[:]); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		var r dns.Msg
+		if err = r.Unpack(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !r.Response || r.Rcode != dns.RcodeRefused || !ids[r.Id] {
+			t.Fatalf("unexpected response %v", r)
+		}
+		delete(ids, r.Id)
+	}
+}
@@ -0,0 +1,26 @@
+package file_util
+
+import (
+	"os"
+	"path"
+)
+
+// WriteAtomic replaces p with data, so a crash never leaves a partially written file behind
+func WriteAtomic(p string, data []byte) error {
+	tmp, err := os.CreateTemp(path.Dir(p), path.Base(p)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
@@ -0,0 +1,26 @@
+package file_util
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	p := path.Join(dir, "state.json")
+	if err := WriteAtomic(p, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAtomic(p, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil || string(data) != "new" {
+		t.Fatalf("unexpected content %q (%v)", data, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("temporary files left behind (%v)", err)
+	}
+}
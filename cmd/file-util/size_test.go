@@ -0,0 +1,15 @@
+package file_util
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{"100": 100, "1k": 1024, "500M": 500 << 20, "2T": 2 << 40, "10GB": 10 << 30}
+	for s, want := range tests {
+		if got, err := ParseSize(s); err != nil || got != want {
+			t.Errorf("ParseSize(%s) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	if _, err := ParseSize("lots"); err == nil {
+		t.Error("expected error")
+	}
+}
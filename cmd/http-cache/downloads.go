@@ -0,0 +1,218 @@
+package http_cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Download is a slice that is currently fetched from upstream.
+// Any number of readers can follow it while it is written, so concurrent requests for the same slice
+// result in a single upstream request.
+type Download struct {
+	store *Store
+	key   string
+	idx   int64
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	ready   bool
+	meta    Meta
+	writer  *sliceWriter
+	written int64
+	done    bool
+	err     error
+}
+
+// afterSliceRename is called by tests once a committed slice is in place, before its download is finished
+var afterSliceRename func()
+
+func downloadKey(key string, idx int64) string {
+	return fmt.Sprintf("%s#%d", key, idx)
+}
+
+// JoinDownload returns the running download of slice idx of key, or registers a new one.
+// If leader is true the caller has to fetch the slice and finish the download using Commit or Abort.
+func (s *Store) JoinDownload(key string, idx int64) (d *Download, leader bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d, found := s.downloads[downloadKey(key, idx)]; found {
+		return d, false
+	}
+
+	d = &Download{store: s, key: key, idx: idx}
+	d.cond = sync.NewCond(&d.mu)
+
+	// The slice might have been committed since the caller looked for it
+	if s.HasSlice(key, idx) {
+		if meta, err := s.ReadMeta(key); err == nil {
+			d.ready = true
+			d.meta = meta
+			d.written = meta.SliceLength(idx)
+			d.done = true
+			return d, false
+		}
+	}
+
+	s.downloads[downloadKey(key, idx)] = d
+	return d, true
+}
+
+func (s *Store) removeDownload(d *Download) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.downloads[downloadKey(d.key, d.idx)] == d {
+		delete(s.downloads, downloadKey(d.key, d.idx))
+	}
+}
+
+// Key returns the cache key of the object the slice belongs to
+func (d *Download) Key() string {
+	return d.key
+}
+
+// Begin is called by the leader once the object the slice belongs to is known
+func (d *Download) Begin(meta Meta) error {
+	writer, err := d.store.createSlice(d.key, d.idx)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.writer = writer
+	d.meta = meta
+	d.ready = true
+	d.cond.Broadcast()
+	return nil
+}
+
+func (d *Download) Write(b []byte) (int, error) {
+	n, err := d.writer.Write(b)
+	d.mu.Lock()
+	d.written += int64(n)
+	d.cond.Broadcast()
+	d.mu.Unlock()
+	return n, err
+}
+
+// Commit stores the slice and wakes up all readers
+func (d *Download) Commit(expectedSize int64) error {
+	// Holding the store lock, JoinDownload either finds this download or the committed slice.
+	// Holding d.mu, NewReader either opens the temporary file before it is renamed or the committed slice.
+	s := d.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.writer.Commit(expectedSize)
+	if afterSliceRename != nil {
+		afterSliceRename()
+	}
+	if err == nil {
+		err = s.addSlice(d.key, d.idx, expectedSize)
+	}
+	if s.downloads[downloadKey(d.key, d.idx)] == d {
+		delete(s.downloads, downloadKey(d.key, d.idx))
+	}
+	d.finishLocked(err)
+	return err
+}
+
+// Abort discards the download, readers receive err
+func (d *Download) Abort(err error) {
+	if d.writer != nil {
+		d.writer.Abort()
+	}
+	d.store.removeDownload(d)
+	d.finish(err)
+}
+
+func (d *Download) finish(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.finishLocked(err)
+}
+
+// finishLocked has to be called with d.mu held
+func (d *Download) finishLocked(err error) {
+	d.done = true
+	d.err = err
+	d.cond.Broadcast()
+}
+
+// WaitMeta blocks until the object the slice belongs to is known
+func (d *Download) WaitMeta() (Meta, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for !d.ready && !d.done {
+		d.cond.Wait()
+	}
+	if !d.ready {
+		return Meta{}, d.err
+	}
+	return d.meta, nil
+}
+
+// NewReader returns a reader of the slice starting at offset, which blocks until the bytes are downloaded
+func (d *Download) NewReader(offset int64) (io.ReadCloser, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for !d.ready && !d.done {
+		d.cond.Wait()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	var f *os.File
+	var err error
+	if d.done {
+		f, err = d.store.OpenSlice(d.key, d.idx)
+	} else {
+		// The file stays readable through this descriptor even after it is renamed or removed
+		f, err = os.Open(d.writer.tmp.Name())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &downloadReader{d: d, f: f, pos: offset}, nil
+}
+
+type downloadReader struct {
+	d   *Download
+	f   *os.File
+	pos int64
+}
+
+func (r *downloadReader) Read(p []byte) (int, error) {
+	d := r.d
+	d.mu.Lock()
+	for r.pos >= d.written && !d.done {
+		d.cond.Wait()
+	}
+	available := d.written - r.pos
+	err := d.err
+	d.mu.Unlock()
+
+	if available <= 0 {
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err := r.f.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *downloadReader) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,187 @@
+package http_cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadCoalescing(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+	meta := Meta{Key: "steam/depot/1/chunk/2", Size: int64(len(body)), SliceSize: int64(len(body))}
+	if err = store.WriteMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	leader, isLeader := store.JoinDownload(meta.Key, 0)
+	if !isLeader {
+		t.Fatal("first caller must be the leader")
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 8)
+	for i := range results {
+		d, isLeader := store.JoinDownload(meta.Key, 0)
+		if isLeader || d != leader {
+			t.Fatal("later callers must join the running download")
+		}
+		wg.Add(1)
+		go func(i int, d *Download) {
+			defer wg.Done()
+			reader, err := d.NewReader(int64(i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer reader.Close()
+			results[i], err = io.ReadAll(reader)
+			if err != nil {
+				t.Error(err)
+			}
+		}(i, d)
+	}
+
+	err = leader.Begin(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(body); i += 1000 {
+		_, err = leader.Write(body[i : i+1000])
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	err = leader.Commit(meta.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	for i, result := range results {
+		if !bytes.Equal(result, body[i:]) {
+			t.Fatalf("reader %d got %d bytes", i, len(result))
+		}
+	}
+	if !store.HasSlice(meta.Key, 0) {
+		t.Fatal("slice not committed")
+	}
+
+	// Once committed, the slice is served from disk
+	d, isLeader := store.JoinDownload(meta.Key, 0)
+	if isLeader {
+		t.Fatal("committed slice must not be downloaded again")
+	}
+	reader, err := d.NewReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	result, _ := io.ReadAll(reader)
+	if !bytes.Equal(result, body) {
+		t.Fatalf("got %d bytes from committed slice", len(result))
+	}
+}
+
+func TestDownloadAbort(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader, _ := store.JoinDownload("key", 3)
+	waiter, _ := store.JoinDownload("key", 3)
+
+	failure := errors.New("upstream went away")
+	go leader.Abort(failure)
+	if _, err = waiter.WaitMeta(); err != failure {
+		t.Fatalf("expected %v, got %v", failure, err)
+	}
+	if _, isLeader := store.JoinDownload("key", 3); !isLeader {
+		t.Fatal("aborted download must be retried")
+	}
+}
+
+func TestCommitAfterDelete(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	meta := Meta{Key: "steam/depot/1/chunk/3", Size: 4, SliceSize: 4}
+	if err = store.WriteMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	d, _ := store.JoinDownload(meta.Key, 0)
+	if err = d.Begin(meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The object is removed while its slice is downloaded
+	if err = store.Delete(meta.Key); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Commit(4); err == nil {
+		t.Fatal("slice of removed object committed")
+	}
+	if _, err = os.Stat(slicePath(store.objectDir(meta.Key), 0)); !os.IsNotExist(err) {
+		t.Fatalf("orphaned slice left on disk (%v)", err)
+	}
+}
+
+func TestDownloadReadersDuringCommit(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	body := []byte("0123456789")
+	meta := Meta{Key: "steam/depot/1/chunk/4", Size: int64(len(body)), SliceSize: int64(len(body))}
+	if err = store.WriteMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	leader, _ := store.JoinDownload(meta.Key, 0)
+	if err = leader.Begin(meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = leader.Write(body); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers join after the temporary file is renamed, before the download is finished
+	var wg sync.WaitGroup
+	afterSliceRename = func() {
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				reader, err := leader.NewReader(0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer reader.Close()
+				if result, err := io.ReadAll(reader); err != nil || !bytes.Equal(result, body) {
+					t.Errorf("got %q (%v)", result, err)
+				}
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer func() { afterSliceRename = nil }()
+
+	if err = leader.Commit(meta.Size); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,178 @@
+package http_cache
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	file_util "resolver/cmd/file-util"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Policy int
+
+const (
+	// PolicyLRU evicts the objects that were not requested for the longest time
+	PolicyLRU Policy = iota
+	// PolicyLFU evicts the objects with the fewest hits, ties are broken by the last access
+	PolicyLFU
+)
+
+func (p Policy) String() string {
+	if p == PolicyLFU {
+		return "lfu"
+	}
+	return "lru"
+}
+
+// EvictionConfig limits the disk space used by the cache, a size of 0 means unlimited
+type EvictionConfig struct {
+	MaxSize        int64
+	ServiceMaxSize map[string]int64
+	Policy         Policy
+	Interval       time.Duration
+}
+
+// LoadEvictionConfig reads the eviction settings from the environment:
+// CACHE_MAX_SIZE (e.g. 2T), CACHE_SERVICE_MAX_SIZE (e.g. steam=1T,blizzard=200G) and CACHE_EVICTION_POLICY (lru or lfu)
+func LoadEvictionConfig() (EvictionConfig, error) {
+	cfg := EvictionConfig{
+		ServiceMaxSize: make(map[string]int64),
+		Policy:         PolicyLRU,
+		Interval:       time.Minute,
+	}
+
+	var err error
+	if v, ok := os.LookupEnv("CACHE_MAX_SIZE"); ok {
+		cfg.MaxSize, err = file_util.ParseSize(v)
+		if err != nil {
+			return EvictionConfig{}, err
+		}
+	}
+	if v, ok := os.LookupEnv("CACHE_SERVICE_MAX_SIZE"); ok {
+		for _, entry := range strings.Split(v, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			service, size, found := strings.Cut(entry, "=")
+			if !found {
+				return EvictionConfig{}, fmt.Errorf("invalid service cache size %q", entry)
+			}
+			cfg.ServiceMaxSize[strings.TrimSpace(service)], err = file_util.ParseSize(size)
+			if err != nil {
+				return EvictionConfig{}, err
+			}
+		}
+	}
+	if v, ok := os.LookupEnv("CACHE_EVICTION_POLICY"); ok {
+		switch strings.ToLower(v) {
+		case "lru":
+			cfg.Policy = PolicyLRU
+		case "lfu":
+			cfg.Policy = PolicyLFU
+		default:
+			return EvictionConfig{}, fmt.Errorf("invalid eviction policy %q", v)
+		}
+	}
+	return cfg, nil
+}
+
+// overBudget has to be called with s.mu held
+func (s *Store) overBudget(service string) bool {
+	if s.eviction.MaxSize > 0 && s.index.Size("") > s.eviction.MaxSize {
+		return true
+	}
+	limit, found := s.eviction.ServiceMaxSize[service]
+	return found && limit > 0 && s.index.Size(service) > limit
+}
+
+// RunEviction keeps the cache within the limits of cfg, it never returns
+func (s *Store) RunEviction(cfg EvictionConfig) {
+	s.mu.Lock()
+	s.eviction = cfg
+	s.mu.Unlock()
+	zap.S().Infof("Cache eviction using %s, max size %d bytes, service limits %v", cfg.Policy, cfg.MaxSize, cfg.ServiceMaxSize)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		s.evict()
+		err := s.index.Sync()
+		if err != nil {
+			zap.S().Errorf("Failed to sync cache index (%s)", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.evictNow:
+		}
+	}
+}
+
+// evict removes objects until all limits are met, services first as they might free enough space globally
+func (s *Store) evict() {
+	s.mu.Lock()
+	cfg := s.eviction
+	s.mu.Unlock()
+
+	for service, limit := range cfg.ServiceMaxSize {
+		if limit > 0 {
+			s.evictUntil(cfg.Policy, service, limit)
+		}
+	}
+	if cfg.MaxSize > 0 {
+		s.evictUntil(cfg.Policy, "", cfg.MaxSize)
+	}
+}
+
+// evictUntil evicts objects of service, or of any service if it is empty, until at most limit bytes are used
+func (s *Store) evictUntil(policy Policy, service string, limit int64) {
+	if s.Size(service) <= limit {
+		return
+	}
+	candidates := s.index.Entries(service)
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if policy == PolicyLFU && a.Hits != b.Hits {
+			return a.Hits < b.Hits
+		}
+		return a.LastAccess < b.LastAccess
+	})
+
+	var evicted int
+	var freed int64
+	for _, candidate := range candidates {
+		if s.Size(service) <= limit {
+			break
+		}
+		// Holding the store lock, no download of the object can start until it is gone
+		s.mu.Lock()
+		if s.isDownloading(candidate.Key) {
+			s.mu.Unlock()
+			continue
+		}
+		err := s.Delete(candidate.Key)
+		s.mu.Unlock()
+		if err != nil {
+			zap.S().Errorf("Failed to evict %s (%s)", candidate.Key, err)
+			continue
+		}
+		evicted++
+		freed += candidate.StoredBytes
+	}
+	if evicted > 0 {
+		zap.S().Infof("Evicted %d objects (%d bytes) to bring %q below %d bytes", evicted, freed, service, limit)
+	}
+}
+
+// isDownloading reports whether a slice of key is downloaded, s.mu has to be held
+func (s *Store) isDownloading(key string) bool {
+	for _, d := range s.downloads {
+		if d.key == key {
+			return true
+		}
+	}
+	return false
+}
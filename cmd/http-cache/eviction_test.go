@@ -0,0 +1,102 @@
+package http_cache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func storeObject(t *testing.T, store *Store, key string, service string, size int) {
+	meta := Meta{Key: key, Service: service, Size: int64(size), SliceSize: int64(size)}
+	if err := store.WriteMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	download, _ := store.JoinDownload(key, 0)
+	if err := download.Begin(meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := download.Write(bytes.Repeat([]byte{'x'}, size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Commit(int64(size)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setAccess(t *testing.T, store *Store, key string, lastAccess int64, hits int64) {
+	found, err := store.index.Update(key, func(entry *IndexEntry) {
+		entry.LastAccess = lastAccess
+		entry.Hits = hits
+	})
+	if err != nil || !found {
+		t.Fatalf("failed to update %s (%v)", key, err)
+	}
+}
+
+func TestEvictionLRU(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		storeObject(t, store, fmt.Sprintf("steam/%d", i), "steam", 100)
+		setAccess(t, store, fmt.Sprintf("steam/%d", i), int64(i), 0)
+	}
+	storeObject(t, store, "blizzard/0", "blizzard", 100)
+	setAccess(t, store, "blizzard/0", 0, 0)
+	setAccess(t, store, "steam/0", 10, 0)
+
+	store.eviction = EvictionConfig{MaxSize: 500, ServiceMaxSize: map[string]int64{"steam": 300}}
+	store.evict()
+
+	if store.Size("steam") != 300 || store.Size("") != 400 {
+		t.Fatalf("unexpected sizes %d/%d", store.Size("steam"), store.Size(""))
+	}
+	// steam/0 was accessed last, so steam/1 and steam/2 are evicted
+	for _, key := range []string{"steam/1", "steam/2"} {
+		if _, err = store.ReadMeta(key); !os.IsNotExist(err) {
+			t.Errorf("%s should be evicted", key)
+		}
+	}
+	for _, key := range []string{"steam/0", "steam/3", "steam/4", "blizzard/0"} {
+		if _, err = store.ReadMeta(key); err != nil {
+			t.Errorf("%s should be kept (%s)", key, err)
+		}
+	}
+
+	// The access history survives a restart
+	store.Touch("blizzard/0")
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blizzard, _ := restarted.index.Get("blizzard/0")
+	steam, _ := restarted.index.Get("steam/0")
+	if restarted.Size("") != 400 || blizzard.Hits != 1 || steam.LastAccess != 10 {
+		t.Fatalf("access state not restored: %d bytes", restarted.Size(""))
+	}
+}
+
+func TestEvictionLFU(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		storeObject(t, store, fmt.Sprintf("epicgames/%d", i), "epicgames", 100)
+		setAccess(t, store, fmt.Sprintf("epicgames/%d", i), 0, int64(10-i))
+	}
+	store.eviction = EvictionConfig{MaxSize: 200, Policy: PolicyLFU}
+	store.evict()
+	if _, err = store.ReadMeta("epicgames/2"); !os.IsNotExist(err) {
+		t.Error("least frequently used object should be evicted")
+	}
+	if store.Size("") != 200 {
+		t.Errorf("unexpected size %d", store.Size(""))
+	}
+}
@@ -0,0 +1,436 @@
+package http_cache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"go.uber.org/zap"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+)
+
+// IndexEntry is everything known about a cached object, so requests can be answered without touching the disk
+type IndexEntry struct {
+	Key          string      `json:"key"`
+	Dir          string      `json:"dir"`
+	Service      string      `json:"service,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	Size         int64       `json:"size"`
+	SliceSize    int64       `json:"slice_size"`
+	Slices       []byte      `json:"slices,omitempty"`
+	StoredBytes  int64       `json:"stored_bytes"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	Stored       int64       `json:"stored"`
+	LastAccess   int64       `json:"last_access"`
+	Hits         int64       `json:"hits"`
+}
+
+func (e *IndexEntry) HasSlice(idx int64) bool {
+	return idx >= 0 && idx/8 < int64(len(e.Slices)) && e.Slices[idx/8]&(1<<(idx%8)) != 0
+}
+
+func (e *IndexEntry) setSlice(idx int64, present bool) {
+	for int64(len(e.Slices)) <= idx/8 {
+		e.Slices = append(e.Slices, 0)
+	}
+	if present {
+		e.Slices[idx/8] |= 1 << (idx % 8)
+	} else {
+		e.Slices[idx/8] &^= 1 << (idx % 8)
+	}
+}
+
+func (e *IndexEntry) Meta() Meta {
+	return Meta{Key: e.Key, Service: e.Service, Header: e.Header, Size: e.Size, SliceSize: e.SliceSize, Stored: e.Stored}
+}
+
+type indexOp string
+
+const (
+	opPut    indexOp = "put"
+	opDelete indexOp = "del"
+	opTouch  indexOp = "touch"
+	// opSlice adds a single slice, so downloading an object does not rewrite its whole entry per slice
+	opSlice indexOp = "slice"
+)
+
+type indexRecord struct {
+	Op         indexOp     `json:"op"`
+	Key        string      `json:"key,omitempty"`
+	Entry      *IndexEntry `json:"entry,omitempty"`
+	LastAccess int64       `json:"last_access,omitempty"`
+	Hits       int64       `json:"hits,omitempty"`
+	Idx        int64       `json:"idx,omitempty"`
+	Size       int64       `json:"size,omitempty"`
+}
+
+// Index is an append-only log of changes to the cached objects, replayed into memory on startup.
+// Every record is one line prefixed with its CRC-32, so a record torn by a crash is detected and dropped.
+// Once the log holds mostly outdated records it is compacted into a fresh one.
+type Index struct {
+	mu           sync.Mutex
+	path         string
+	f            *os.File
+	entries      map[string]*IndexEntry
+	touched      map[string]struct{}
+	records      int
+	serviceSizes map[string]int64
+	totalSize    int64
+}
+
+// OpenIndex replays the index at p, creating it if it does not exist
+func OpenIndex(p string) (*Index, error) {
+	x := &Index{
+		path:         p,
+		entries:      make(map[string]*IndexEntry),
+		touched:      make(map[string]struct{}),
+		serviceSizes: make(map[string]int64),
+	}
+	err := x.replay()
+	if err != nil {
+		return nil, err
+	}
+	x.f, err = os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *Index) replay() error {
+	f, err := os.Open(x.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	var corrupt int
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// The last record was not completely written, cut it off so new records start on a fresh line
+				zap.S().Warnf("Dropping torn record at the end of cache index %s", x.path)
+				return os.Truncate(x.path, offset)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+
+		record, err := decodeRecord(line)
+		if err != nil {
+			corrupt++
+			continue
+		}
+		x.apply(record)
+		x.records++
+	}
+	if corrupt > 0 {
+		zap.S().Warnf("Skipped %d corrupt records in cache index %s", corrupt, x.path)
+	}
+	return nil
+}
+
+func encodeRecord(record indexRecord) ([]byte, error) {
+	data, err := jsoniter.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)), nil
+}
+
+func decodeRecord(line []byte) (indexRecord, error) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	if len(line) < 10 || line[8] != ' ' {
+		return indexRecord{}, fmt.Errorf("invalid record")
+	}
+	var sum uint32
+	_, err := fmt.Sscanf(string(line[:8]), "%08x", &sum)
+	if err != nil {
+		return indexRecord{}, err
+	}
+	data := line[9:]
+	if crc32.ChecksumIEEE(data) != sum {
+		return indexRecord{}, fmt.Errorf("checksum mismatch")
+	}
+	var record indexRecord
+	err = jsoniter.Unmarshal(data, &record)
+	return record, err
+}
+
+// apply has to be called with x.mu held, or before the index is shared
+func (x *Index) apply(record indexRecord) {
+	switch record.Op {
+	case opPut:
+		if record.Entry == nil {
+			return
+		}
+		x.remove(record.Entry.Key)
+		x.entries[record.Entry.Key] = record.Entry
+		x.serviceSizes[record.Entry.Service] += record.Entry.StoredBytes
+		x.totalSize += record.Entry.StoredBytes
+	case opDelete:
+		x.remove(record.Key)
+	case opTouch:
+		if entry, found := x.entries[record.Key]; found {
+			entry.LastAccess = record.LastAccess
+			entry.Hits = record.Hits
+		}
+	case opSlice:
+		if entry, found := x.entries[record.Key]; found && !entry.HasSlice(record.Idx) {
+			entry.setSlice(record.Idx, true)
+			entry.StoredBytes += record.Size
+			x.serviceSizes[entry.Service] += record.Size
+			x.totalSize += record.Size
+		}
+	}
+}
+
+func (x *Index) remove(key string) {
+	if entry, found := x.entries[key]; found {
+		x.serviceSizes[entry.Service] -= entry.StoredBytes
+		x.totalSize -= entry.StoredBytes
+		delete(x.entries, key)
+		delete(x.touched, key)
+	}
+}
+
+// append has to be called with x.mu held
+func (x *Index) append(record indexRecord) error {
+	line, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	_, err = x.f.Write(line)
+	if err != nil {
+		return err
+	}
+	x.records++
+	return nil
+}
+
+// Get returns a copy of the entry of key
+func (x *Index) Get(key string) (IndexEntry, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entry, found := x.entries[key]
+	if !found {
+		return IndexEntry{}, false
+	}
+	return entry.copy(), true
+}
+
+func (e *IndexEntry) copy() IndexEntry {
+	c := *e
+	c.Slices = append([]byte(nil), e.Slices...)
+	return c
+}
+
+// Put stores entry, replacing any previous entry of its key
+func (x *Index) Put(entry IndexEntry) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.put(entry)
+}
+
+func (x *Index) put(entry IndexEntry) error {
+	entry.ETag = entry.Header.Get("ETag")
+	entry.LastModified = entry.Header.Get("Last-Modified")
+	record := indexRecord{Op: opPut, Entry: &entry}
+	err := x.append(record)
+	if err != nil {
+		return err
+	}
+	c := entry.copy()
+	record.Entry = &c
+	x.apply(record)
+	return nil
+}
+
+// Update changes the entry of key using fn, reporting whether key was found
+func (x *Index) Update(key string, fn func(entry *IndexEntry)) (bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entry, found := x.entries[key]
+	if !found {
+		return false, nil
+	}
+	c := entry.copy()
+	fn(&c)
+	return true, x.put(c)
+}
+
+// AddSlice records that slice idx of key with size bytes is stored.
+// It returns the service of key and whether key was found.
+func (x *Index) AddSlice(key string, idx int64, size int64) (string, bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entry, found := x.entries[key]
+	if !found {
+		return "", false, nil
+	}
+	if entry.HasSlice(idx) {
+		return entry.Service, true, nil
+	}
+	record := indexRecord{Op: opSlice, Key: key, Idx: idx, Size: size}
+	err := x.append(record)
+	if err != nil {
+		return "", true, err
+	}
+	x.apply(record)
+	return entry.Service, true, nil
+}
+
+func (x *Index) Delete(key string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, found := x.entries[key]; !found {
+		return nil
+	}
+	x.remove(key)
+	return x.append(indexRecord{Op: opDelete, Key: key})
+}
+
+// Touch records an access of key in memory, it is written to the log by the next Sync
+func (x *Index) Touch(key string, now int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if entry, found := x.entries[key]; found {
+		entry.LastAccess = now
+		entry.Hits++
+		x.touched[key] = struct{}{}
+	}
+}
+
+// Size returns the number of bytes stored for service, or for the whole cache if service is empty
+func (x *Index) Size(service string) int64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if service == "" {
+		return x.totalSize
+	}
+	return x.serviceSizes[service]
+}
+
+// Len returns the number of indexed objects
+func (x *Index) Len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.entries)
+}
+
+// Entries returns copies of all entries of service, or of all entries if service is empty
+func (x *Index) Entries(service string) []IndexEntry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entries := make([]IndexEntry, 0, len(x.entries))
+	for _, entry := range x.entries {
+		if service == "" || entry.Service == service {
+			entries = append(entries, entry.copy())
+		}
+	}
+	return entries
+}
+
+// Sync writes pending accesses and flushes the log to disk, compacting it if most records are outdated
+func (x *Index) Sync() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for key := range x.touched {
+		entry := x.entries[key]
+		err := x.append(indexRecord{Op: opTouch, Key: key, LastAccess: entry.LastAccess, Hits: entry.Hits})
+		if err != nil {
+			return err
+		}
+	}
+	x.touched = make(map[string]struct{})
+
+	if x.records > 1000 && x.records > 2*len(x.entries) {
+		return x.compact()
+	}
+	return x.f.Sync()
+}
+
+// compact replaces the log with one holding a single record per entry, it has to be called with x.mu held
+func (x *Index) compact() error {
+	tmp, err := os.CreateTemp(path.Dir(x.path), path.Base(x.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range x.entries {
+		var line []byte
+		line, err = encodeRecord(indexRecord{Op: opPut, Entry: entry})
+		if err != nil {
+			break
+		}
+		_, err = writer.Write(line)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), x.path)
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	syncDir(path.Dir(x.path))
+
+	_ = x.f.Close()
+	x.f, err = os.OpenFile(x.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	zap.S().Infof("Compacted cache index from %d to %d records", x.records, len(x.entries))
+	x.records = len(x.entries)
+	return nil
+}
+
+// Close flushes and closes the log
+func (x *Index) Close() error {
+	err := x.Sync()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if closeErr := x.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
@@ -0,0 +1,228 @@
+package http_cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIndexReplay(t *testing.T) {
+	p := path.Join(t.TempDir(), "index.log")
+	index, err := OpenIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{}
+	header.Set("ETag", `"abc"`)
+	err = index.Put(IndexEntry{Key: "steam/a", Service: "steam", Header: header, Size: 10, SliceSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = index.Update("steam/a", func(entry *IndexEntry) {
+		entry.setSlice(2, true)
+		entry.StoredBytes += 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Put(IndexEntry{Key: "steam/b", Service: "steam", SliceSize: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Delete("steam/b"); err != nil {
+		t.Fatal(err)
+	}
+	index.Touch("steam/a", 1234)
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of writing a record
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`0badc0de {"op":"put","entry":{"key":"tor`)
+	_ = f.Close()
+
+	index, err = OpenIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, found := index.Get("steam/a")
+	if !found || !entry.HasSlice(2) || entry.HasSlice(1) || entry.ETag != `"abc"` || entry.LastAccess != 1234 || entry.Hits != 1 {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	if _, found = index.Get("steam/b"); found {
+		t.Fatal("deleted entry was restored")
+	}
+	if index.Size("steam") != 2 {
+		t.Fatalf("unexpected size %d", index.Size("steam"))
+	}
+
+	// New records must be readable after the torn one was cut off
+	if err = index.Put(IndexEntry{Key: "steam/c", SliceSize: 4}); err != nil {
+		t.Fatal(err)
+	}
+	_ = index.Close()
+	index, err = OpenIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found = index.Get("steam/c"); !found || index.Len() != 2 {
+		t.Fatalf("record after torn write lost, %d entries", index.Len())
+	}
+	_ = index.Close()
+}
+
+func TestIndexCompaction(t *testing.T) {
+	p := path.Join(t.TempDir(), "index.log")
+	index, err := OpenIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if err = index.Put(IndexEntry{Key: fmt.Sprintf("k%d", i%10), SliceSize: 1, StoredBytes: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = index.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if index.records != 10 {
+		t.Fatalf("index not compacted, %d records", index.records)
+	}
+	if err = index.Put(IndexEntry{Key: "after", SliceSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+	_ = index.Close()
+
+	index, err = OpenIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if index.Len() != 11 || index.Size("") != 10 {
+		t.Fatalf("unexpected index after compaction: %d entries, %d bytes", index.Len(), index.Size(""))
+	}
+}
+
+func TestIndexSliceRecords(t *testing.T) {
+	p := path.Join(t.TempDir(), "index.log")
+	index, err := OpenIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	if err = index.Put(IndexEntry{Key: "steam/big", Service: "steam", Header: header, Size: 4000, SliceSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putSize := fi.Size()
+	for idx := int64(0); idx < 4000; idx++ {
+		if _, _, err = index.AddSlice("steam/big", idx, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Adding a slice twice is not counted twice
+	if service, found, err := index.AddSlice("steam/big", 7, 1); service != "steam" || !found || err != nil {
+		t.Fatalf("unexpected result for stored slice: %q %t %v", service, found, err)
+	}
+	if _, found, _ := index.AddSlice("steam/missing", 0, 1); found {
+		t.Fatal("slice added to missing entry")
+	}
+	_ = index.Close()
+
+	// Slice records stay small however many slices the entry has
+	fi, err = os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perSlice := (fi.Size() - putSize) / 4000; perSlice > 100 {
+		t.Fatalf("slice records take %d bytes each", perSlice)
+	}
+
+	index, err = OpenIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	entry, found := index.Get("steam/big")
+	if !found || !entry.HasSlice(0) || !entry.HasSlice(3999) || entry.StoredBytes != 4000 || index.Size("steam") != 4000 {
+		t.Fatalf("slices not replayed: %d bytes", entry.StoredBytes)
+	}
+}
+
+func TestStoreConsistencyCheck(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeObject(t, store, "riot/0", "riot", 42)
+	storeObject(t, store, "riot/1", "riot", 42)
+	storeObject(t, store, "riot/2", "riot", 42)
+	_ = store.Close()
+
+	// One object vanished completely, another lost its slice
+	if err = os.RemoveAll(store.objectDir("riot/0")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(slicePath(store.objectDir("riot/1"), 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("CACHE_INDEX_CHECK", "full")
+	store, err = NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.ReadMeta("riot/0"); !os.IsNotExist(err) {
+		t.Error("vanished object still indexed")
+	}
+	if store.HasSlice("riot/1", 0) || !store.HasSlice("riot/2", 0) {
+		t.Error("slices not checked")
+	}
+	if store.Size("riot") != 42 {
+		t.Errorf("unexpected size %d", store.Size("riot"))
+	}
+	_ = store.Close()
+
+	// Without an index, it is rebuilt from the files on disk
+	if err = os.Remove(path.Join(dir, "index.log")); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Size("riot") != 42 || !store.HasSlice("riot/2", 0) {
+		t.Fatalf("index not rebuilt, %d bytes", store.Size("riot"))
+	}
+}
+
+func TestStoreLock(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewStore(dir); !errors.Is(err, ErrStoreLocked) {
+		t.Fatalf("second store opened (%v)", err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+}
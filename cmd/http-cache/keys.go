@@ -0,0 +1,126 @@
+package http_cache
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// KeyRule controls how the cache key of a request is built
+type KeyRule struct {
+	// IncludeHost keeps the requested host in the key, otherwise the service name replaces it,
+	// so the same object fetched from different CDN hosts is only stored once
+	IncludeHost bool
+	// IncludeQuery appends the query string to the key
+	IncludeQuery bool
+}
+
+// defaultKeyRules covers the uklans cache-domains services whose hosts all serve the same content.
+// This is what the nginx based lancache does for every service using its $cacheidentifier.
+var defaultKeyRules = map[string]KeyRule{
+	"arenanet":     {},
+	"blizzard":     {},
+	"bsg":          {},
+	"cityofheroes": {},
+	"daybreak":     {},
+	"epicgames":    {},
+	"frontier":     {},
+	"neverwinter":  {},
+	"nexusmods":    {},
+	"nintendo":     {},
+	"origin":       {},
+	"pathofexile":  {},
+	"renegadex":    {},
+	"riot":         {},
+	"rockstar":     {},
+	"sony":         {},
+	"square":       {},
+	"steam":        {},
+	"teso":         {},
+	"uplay":        {},
+	"warframe":     {},
+	"wargaming":    {},
+}
+
+// defaultKeyRule is used for services without a rule and for hosts that do not belong to any service
+var defaultKeyRule = KeyRule{IncludeHost: true}
+
+// KeyRules maps service names to the rule used for their cache keys
+type KeyRules map[string]KeyRule
+
+// LoadKeyRules returns the default rules, overridden by CACHE_KEY_RULES.
+// CACHE_KEY_RULES is a comma separated list of service=mode pairs,
+// mode being one of service, host, service+query or host+query.
+func LoadKeyRules() (KeyRules, error) {
+	rules := make(KeyRules, len(defaultKeyRules))
+	for service, rule := range defaultKeyRules {
+		rules[service] = rule
+	}
+
+	config, ok := os.LookupEnv("CACHE_KEY_RULES")
+	if !ok {
+		return rules, nil
+	}
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		service, mode, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid cache key rule %q", entry)
+		}
+		var rule KeyRule
+		switch strings.TrimSpace(mode) {
+		case "service":
+		case "service+query":
+			rule.IncludeQuery = true
+		case "host":
+			rule.IncludeHost = true
+		case "host+query":
+			rule.IncludeHost = true
+			rule.IncludeQuery = true
+		default:
+			return nil, fmt.Errorf("invalid cache key mode %q for %s", mode, service)
+		}
+		rules[strings.TrimSpace(service)] = rule
+	}
+	return rules, nil
+}
+
+// Rule returns the rule of service, which is empty for hosts without a service
+func (k KeyRules) Rule(service string) KeyRule {
+	if service == "" {
+		return defaultKeyRule
+	}
+	if rule, found := k[service]; found {
+		return rule
+	}
+	return defaultKeyRule
+}
+
+// Key returns the cache key for a request of u on host, which belongs to service
+func (k KeyRules) Key(service string, host string, u *url.URL) string {
+	rule := k.Rule(service)
+	var key string
+	if rule.IncludeHost {
+		key = strings.ToLower(StripPort(host))
+	} else {
+		key = service
+	}
+	key += u.EscapedPath()
+	if rule.IncludeQuery && u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return key
+}
+
+// StripPort removes the port of a Host header, if there is one
+func StripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
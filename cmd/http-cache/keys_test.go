@@ -0,0 +1,41 @@
+package http_cache
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestKeyRules(t *testing.T) {
+	t.Setenv("CACHE_KEY_RULES", "wsus=host+query, steam=service")
+	rules, err := LoadKeyRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk, _ := url.Parse("/depot/431961/chunk/abc?token=1")
+	update, _ := url.Parse("/d/msdownload/update.cab?p=1")
+	tests := []struct {
+		service string
+		host    string
+		u       *url.URL
+		want    string
+	}{
+		{"steam", "cache8-fra1.steamcontent.com", chunk, "steam/depot/431961/chunk/abc"},
+		{"steam", "cache11-fra1.steamcontent.com:80", chunk, "steam/depot/431961/chunk/abc"},
+		{"wsus", "Download.WindowsUpdate.com", update, "download.windowsupdate.com/d/msdownload/update.cab?p=1"},
+		{"", "example.com", chunk, "example.com/depot/431961/chunk/abc"},
+		{"unknown", "example.com", chunk, "example.com/depot/431961/chunk/abc"},
+	}
+	for _, test := range tests {
+		if key := rules.Key(test.service, test.host, test.u); key != test.want {
+			t.Errorf("Key(%s, %s) = %s; want %s", test.service, test.host, key, test.want)
+		}
+	}
+}
+
+func TestKeyRulesInvalid(t *testing.T) {
+	t.Setenv("CACHE_KEY_RULES", "steam=everything")
+	if _, err := LoadKeyRules(); err == nil {
+		t.Fatal("expected error for invalid mode")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package http_cache
+
+import "os"
+
+// lockFile does nothing where flock is not available
+func lockFile(f *os.File) error {
+	return nil
+}
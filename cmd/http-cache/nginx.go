@@ -0,0 +1,126 @@
+package http_cache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// nginx writes a binary ngx_http_file_cache_header_t, followed by the cache key and the upstream response headers
+var nginxKeyMarker = []byte("\nKEY: ")
+
+// nginxHeaderLimit bounds how much of a cache file is read to find the response headers
+const nginxHeaderLimit = 64 * 1024
+
+// NginxCacheFile is an entry of an nginx proxy_cache directory
+type NginxCacheFile struct {
+	Path       string
+	Key        string
+	StatusCode int
+	Header     http.Header
+	BodyOffset int64
+	BodyLength int64
+}
+
+// ParseNginxCacheFile reads the key and response headers of an nginx cache file
+func ParseNginxCacheFile(p string) (*NginxCacheFile, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, nginxHeaderLimit)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	keyStart := bytes.Index(head, nginxKeyMarker)
+	if keyStart < 0 {
+		return nil, fmt.Errorf("no cache key in %s", p)
+	}
+	keyStart += len(nginxKeyMarker)
+	keyEnd := bytes.IndexByte(head[keyStart:], '\n')
+	if keyEnd < 0 {
+		return nil, fmt.Errorf("unterminated cache key in %s", p)
+	}
+	key := string(head[keyStart : keyStart+keyEnd])
+	headerStart := keyStart + keyEnd + 1
+
+	headerEnd := bytes.Index(head[headerStart:], []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return nil, fmt.Errorf("unterminated response headers in %s", p)
+	}
+	bodyOffset := int64(headerStart + headerEnd + 4)
+
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head[headerStart:bodyOffset])), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response headers in %s (%s)", p, err)
+	}
+	_ = response.Body.Close()
+
+	return &NginxCacheFile{
+		Path:       p,
+		Key:        key,
+		StatusCode: response.StatusCode,
+		Header:     response.Header,
+		BodyOffset: bodyOffset,
+		BodyLength: fi.Size() - bodyOffset,
+	}, nil
+}
+
+// Body returns a reader of the cached response body in f, which has to be the opened cache file
+func (c *NginxCacheFile) Body(f io.ReaderAt) *io.SectionReader {
+	return io.NewSectionReader(f, c.BodyOffset, c.BodyLength)
+}
+
+// lancacheKeyRegex splits keys built from "proxy_cache_key $cacheidentifier$uri$slice_range"
+var lancacheKeyRegex = regexp.MustCompile(`^([^/]+)(/.*?)(bytes=(\d+)-(\d+))?$`)
+
+// LancacheKey is a parsed key of the nginx based lancache.
+// Identifier is the cache_domains service name, or the host for domains not belonging to any service.
+type LancacheKey struct {
+	Identifier string
+	URI        string
+	Range      bool
+	Start      int64
+	End        int64
+}
+
+// IsHost reports whether the identifier is a host rather than a service name
+func (k LancacheKey) IsHost() bool {
+	return strings.ContainsAny(k.Identifier, ".:")
+}
+
+func ParseLancacheKey(key string) (LancacheKey, error) {
+	matches := lancacheKeyRegex.FindStringSubmatch(key)
+	if matches == nil {
+		return LancacheKey{}, fmt.Errorf("unsupported cache key %q", key)
+	}
+	k := LancacheKey{Identifier: matches[1], URI: matches[2]}
+	if matches[3] != "" {
+		var err error
+		k.Range = true
+		k.Start, err = strconv.ParseInt(matches[4], 10, 64)
+		if err != nil {
+			return LancacheKey{}, err
+		}
+		k.End, err = strconv.ParseInt(matches[5], 10, 64)
+		if err != nil {
+			return LancacheKey{}, err
+		}
+	}
+	return k, nil
+}
@@ -0,0 +1,67 @@
+package http_cache
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+// writeNginxCacheFile writes a cache file in the layout of nginx 1.x, with a zeroed binary header
+func writeNginxCacheFile(t *testing.T, p string, key string, head string, body []byte) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 336))
+	buf.WriteString("\nKEY: " + key + "\n")
+	buf.WriteString(head)
+	buf.Write(body)
+	if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseNginxCacheFile(t *testing.T) {
+	p := path.Join(t.TempDir(), "d41d8cd98f00b204e9800998ecf8427e")
+	body := []byte("0123456789")
+	writeNginxCacheFile(t, p, "steam/depot/431961/chunk/abcbytes=0-1048575",
+		"HTTP/1.1 206 Partial Content\r\nContent-Type: application/x-steam-chunk\r\nContent-Range: bytes 0-9/10\r\nContent-Length: 10\r\nETag: \"x\"\r\n\r\n", body)
+
+	c, err := ParseNginxCacheFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Key != "steam/depot/431961/chunk/abcbytes=0-1048575" || c.StatusCode != 206 || c.Header.Get("ETag") != `"x"` || c.BodyLength != 10 {
+		t.Fatalf("unexpected cache file %+v", c)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, _ := io.ReadAll(c.Body(f))
+	if !bytes.Equal(got, body) {
+		t.Fatalf("unexpected body %q", got)
+	}
+}
+
+func TestParseLancacheKey(t *testing.T) {
+	k, err := ParseLancacheKey("steam/depot/431961/chunk/abcbytes=1048576-2097151")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Identifier != "steam" || k.URI != "/depot/431961/chunk/abc" || !k.Range || k.Start != 1048576 || k.End != 2097151 || k.IsHost() {
+		t.Fatalf("unexpected key %+v", k)
+	}
+
+	k, err = ParseLancacheKey("download.windowsupdate.com/d/msdownload/update.cab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Identifier != "download.windowsupdate.com" || k.URI != "/d/msdownload/update.cab" || k.Range || !k.IsHost() {
+		t.Fatalf("unexpected key %+v", k)
+	}
+
+	if _, err = ParseLancacheKey("no-uri"); err == nil {
+		t.Fatal("expected error")
+	}
+}
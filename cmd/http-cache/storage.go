@@ -0,0 +1,443 @@
+package http_cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	file_util "resolver/cmd/file-util"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSliceSize matches the 1 MiB slices used by the nginx based lancache
+const DefaultSliceSize int64 = 1 << 20
+
+// ErrStoreLocked is returned when another process has the cache open
+var ErrStoreLocked = errors.New("cache is in use by another process")
+
+// GetCacheDir returns the directory cached HTTP objects are stored in.
+// It defaults to a folder next to the cache-domains checkout and can be overridden using CACHE_DIR.
+func GetCacheDir() string {
+	p, ok := os.LookupEnv("CACHE_DIR")
+	if !ok {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			zap.S().Fatal(err)
+		}
+		p = path.Join(dir, "abs-resolver", "http-cache")
+	}
+	err := os.MkdirAll(p, 0755)
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	return p
+}
+
+// Meta describes a cached object.
+// The body of an object is split into slices of SliceSize bytes, only the last one may be shorter.
+type Meta struct {
+	Key       string      `json:"key"`
+	Service   string      `json:"service,omitempty"`
+	Header    http.Header `json:"header"`
+	Size      int64       `json:"size"`
+	SliceSize int64       `json:"slice_size"`
+	Stored    int64       `json:"stored"`
+}
+
+func (m Meta) SliceCount() int64 {
+	return (m.Size + m.SliceSize - 1) / m.SliceSize
+}
+
+// SliceLength returns the number of bytes in slice idx
+func (m Meta) SliceLength(idx int64) int64 {
+	length := m.Size - idx*m.SliceSize
+	if length > m.SliceSize {
+		return m.SliceSize
+	}
+	if length < 0 {
+		return 0
+	}
+	return length
+}
+
+// Store keeps cached objects on disk.
+// Every object lives in its own directory, named after the SHA-256 of its key,
+// holding a JSON file with its Meta and one file per downloaded slice.
+// Lookups are answered by the Index, the metadata files are only read to rebuild a lost index.
+type Store struct {
+	dir   string
+	index *Index
+	// lock keeps other processes from opening the cache at the same time
+	lock *os.File
+
+	mu        sync.Mutex
+	downloads map[string]*Download
+	eviction  EvictionConfig
+	evictNow  chan struct{}
+}
+
+// NewStore opens the cache in dir, which only one process can have open at a time.
+// The index is checked against the object directories on disk, with CACHE_INDEX_CHECK=full every slice is checked.
+func NewStore(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(path.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(lock)
+	if err != nil {
+		_ = lock.Close()
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+
+	indexPath := path.Join(dir, "index.log")
+	_, statErr := os.Stat(indexPath)
+	index, err := OpenIndex(indexPath)
+	if err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+
+	s := &Store{
+		dir:       dir,
+		index:     index,
+		lock:      lock,
+		downloads: make(map[string]*Download),
+		evictNow:  make(chan struct{}, 1),
+	}
+	if os.IsNotExist(statErr) {
+		err = s.rebuildIndex()
+	} else {
+		err = s.checkIndex(os.Getenv("CACHE_INDEX_CHECK") == "full")
+	}
+	if err != nil {
+		_ = index.Close()
+		_ = lock.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close flushes the index and releases the cache for other processes
+func (s *Store) Close() error {
+	err := s.index.Close()
+	if closeErr := s.lock.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func objectName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return path.Join(name[:2], name)
+}
+
+func (s *Store) objectDir(key string) string {
+	return path.Join(s.dir, objectName(key))
+}
+
+func slicePath(dir string, idx int64) string {
+	return path.Join(dir, fmt.Sprintf("slice-%08d", idx))
+}
+
+// ReadMeta returns the Meta of key, or an error satisfying os.IsNotExist if it is not cached
+func (s *Store) ReadMeta(key string) (Meta, error) {
+	entry, found := s.index.Get(key)
+	if !found {
+		return Meta{}, &os.PathError{Op: "read", Path: key, Err: os.ErrNotExist}
+	}
+	if entry.SliceSize <= 0 {
+		return Meta{}, fmt.Errorf("invalid slice size %d for %s", entry.SliceSize, key)
+	}
+	return entry.Meta(), nil
+}
+
+// WriteMeta stores meta.
+// Slices already stored for the same version of the object are kept, those of other versions are removed.
+func (s *Store) WriteMeta(meta Meta) error {
+	dir := s.objectDir(meta.Key)
+	if meta.Stored == 0 {
+		meta.Stored = time.Now().Unix()
+	}
+
+	entry := IndexEntry{
+		Key:        meta.Key,
+		Dir:        objectName(meta.Key),
+		Service:    meta.Service,
+		Header:     meta.Header,
+		Size:       meta.Size,
+		SliceSize:  meta.SliceSize,
+		Stored:     meta.Stored,
+		LastAccess: meta.Stored,
+	}
+	if old, found := s.index.Get(meta.Key); found {
+		if old.Size == meta.Size && old.SliceSize == meta.SliceSize && old.ETag == meta.Header.Get("ETag") {
+			entry.Slices = old.Slices
+			entry.StoredBytes = old.StoredBytes
+			entry.Stored = old.Stored
+			entry.LastAccess = old.LastAccess
+			entry.Hits = old.Hits
+		} else {
+			err := s.Delete(meta.Key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	bytes, err := jsoniter.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	err = file_util.WriteAtomic(path.Join(dir, "meta.json"), bytes)
+	if err != nil {
+		return err
+	}
+	return s.index.Put(entry)
+}
+
+// HasSlice reports whether slice idx of key is stored
+func (s *Store) HasSlice(key string, idx int64) bool {
+	entry, found := s.index.Get(key)
+	return found && entry.HasSlice(idx)
+}
+
+// OpenSlice opens slice idx of key, the caller has to close it.
+// Slices that lost data, for example in a power loss, are dropped so they are downloaded again.
+func (s *Store) OpenSlice(key string, idx int64) (*os.File, error) {
+	entry, found := s.index.Get(key)
+	if !found || !entry.HasSlice(idx) {
+		return nil, &os.PathError{Op: "open", Path: fmt.Sprintf("%s#%d", key, idx), Err: os.ErrNotExist}
+	}
+	f, err := os.Open(slicePath(s.objectDir(key), idx))
+	if os.IsNotExist(err) {
+		zap.S().Warnf("Slice %d of %s vanished from disk", idx, key)
+		s.dropSlice(key, idx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if expected := entry.Meta().SliceLength(idx); fi.Size() != expected {
+		_ = f.Close()
+		zap.S().Warnf("Slice %d of %s has %d bytes instead of %d", idx, key, fi.Size(), expected)
+		s.dropSlice(key, idx)
+		return nil, &os.PathError{Op: "open", Path: fmt.Sprintf("%s#%d", key, idx), Err: os.ErrNotExist}
+	}
+	return f, nil
+}
+
+func (s *Store) dropSlice(key string, idx int64) {
+	_, err := s.index.Update(key, func(entry *IndexEntry) {
+		if entry.HasSlice(idx) {
+			entry.setSlice(idx, false)
+			entry.StoredBytes -= entry.Meta().SliceLength(idx)
+		}
+	})
+	if err != nil {
+		zap.S().Errorf("Failed to update cache index (%s)", err)
+	}
+}
+
+// addSlice records a committed slice, s.mu has to be held
+func (s *Store) addSlice(key string, idx int64, size int64) error {
+	service, found, err := s.index.AddSlice(key, idx, size)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// The object was removed while the slice was downloaded, nothing would account for the file
+		_ = os.Remove(slicePath(s.objectDir(key), idx))
+		return fmt.Errorf("%s was removed while slice %d was downloaded", key, idx)
+	}
+
+	if s.overBudget(service) {
+		select {
+		case s.evictNow <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Delete removes key and all of its slices
+func (s *Store) Delete(key string) error {
+	err := s.index.Delete(key)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(s.objectDir(key))
+}
+
+// Touch records a request for key
+func (s *Store) Touch(key string) {
+	s.index.Touch(key, time.Now().Unix())
+}
+
+// Size returns the number of bytes stored for service, or for the whole cache if service is empty
+func (s *Store) Size(service string) int64 {
+	return s.index.Size(service)
+}
+
+// rebuildIndex indexes all objects found on disk, losing their access history
+func (s *Store) rebuildIndex() error {
+	zap.S().Infof("Building cache index from %s", s.dir)
+	err := filepath.Walk(s.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() != "meta.json" {
+			return err
+		}
+		bytes, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var meta Meta
+		err = jsoniter.Unmarshal(bytes, &meta)
+		if err != nil || meta.SliceSize <= 0 {
+			zap.S().Warnf("Skipping invalid cache metadata %s (%v)", p, err)
+			return nil
+		}
+		entry := IndexEntry{
+			Key:        meta.Key,
+			Dir:        objectName(meta.Key),
+			Service:    meta.Service,
+			Header:     meta.Header,
+			Size:       meta.Size,
+			SliceSize:  meta.SliceSize,
+			Stored:     meta.Stored,
+			LastAccess: meta.Stored,
+		}
+		entries, err := os.ReadDir(filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			var idx int64
+			if strings.HasSuffix(e.Name(), ".tmp") {
+				_ = os.Remove(path.Join(filepath.Dir(p), e.Name()))
+				continue
+			}
+			if _, err := fmt.Sscanf(e.Name(), "slice-%d", &idx); err != nil {
+				continue
+			}
+			if fi, err := e.Info(); err == nil && fi.Size() == meta.SliceLength(idx) {
+				entry.setSlice(idx, true)
+				entry.StoredBytes += fi.Size()
+			}
+		}
+		return s.index.Put(entry)
+	})
+	if err != nil {
+		return err
+	}
+	zap.S().Infof("Indexed %d cached objects (%d bytes)", s.index.Len(), s.index.Size(""))
+	return s.index.Sync()
+}
+
+// checkIndex drops index entries whose files are gone.
+// Checking every slice is expensive on large caches, so by default only the object directories are checked
+// and slices that vanished are noticed when they are opened.
+func (s *Store) checkIndex(full bool) error {
+	var dropped, droppedSlices int
+	for _, entry := range s.index.Entries("") {
+		dir := path.Join(s.dir, entry.Dir)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			dropped++
+			if err = s.index.Delete(entry.Key); err != nil {
+				return err
+			}
+			continue
+		}
+		if !full {
+			continue
+		}
+		meta := entry.Meta()
+		for idx := int64(0); idx < meta.SliceCount(); idx++ {
+			if !entry.HasSlice(idx) {
+				continue
+			}
+			fi, err := os.Stat(slicePath(dir, idx))
+			if err == nil && fi.Size() == meta.SliceLength(idx) {
+				continue
+			}
+			droppedSlices++
+			s.dropSlice(entry.Key, idx)
+		}
+	}
+	if dropped > 0 || droppedSlices > 0 {
+		zap.S().Warnf("Cache index check dropped %d objects and %d slices missing on disk", dropped, droppedSlices)
+	}
+	zap.S().Infof("Cache index holds %d objects (%d bytes)", s.index.Len(), s.index.Size(""))
+	return s.index.Sync()
+}
+
+// sliceWriter receives a slice while it is downloaded.
+// Nothing becomes visible until Commit is called and the slice is added to the index.
+type sliceWriter struct {
+	path    string
+	tmp     *os.File
+	written int64
+}
+
+func (s *Store) createSlice(key string, idx int64) (*sliceWriter, error) {
+	dir := s.objectDir(key)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	p := slicePath(dir, idx)
+	tmp, err := os.CreateTemp(dir, path.Base(p)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &sliceWriter{path: p, tmp: tmp}, nil
+}
+
+func (w *sliceWriter) Write(b []byte) (int, error) {
+	n, err := w.tmp.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Commit moves the slice into place if exactly expectedSize bytes were written
+func (w *sliceWriter) Commit(expectedSize int64) error {
+	if expectedSize != w.written {
+		w.Abort()
+		return fmt.Errorf("short slice %s (expected %d bytes, got %d)", w.path, expectedSize, w.written)
+	}
+	err := w.tmp.Close()
+	if err != nil {
+		_ = os.Remove(w.tmp.Name())
+		return err
+	}
+	err = os.Rename(w.tmp.Name(), w.path)
+	if err != nil {
+		_ = os.Remove(w.tmp.Name())
+	}
+	return err
+}
+
+// Abort discards everything written so far
+func (w *sliceWriter) Abort() {
+	_ = w.tmp.Close()
+	_ = os.Remove(w.tmp.Name())
+}
@@ -0,0 +1,115 @@
+package http_cache
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestStoreRoundtrip(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "cache8-fra1.steamcontent.com/depot/431961/chunk/abc"
+	if _, err = store.ReadMeta(key); !os.IsNotExist(err) {
+		t.Fatalf("expected miss, got %v", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-steam-chunk")
+	err = store.WriteMeta(Meta{Key: key, Header: header, Size: 11, SliceSize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := store.ReadMeta(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.SliceCount() != 2 || meta.SliceLength(0) != 8 || meta.SliceLength(1) != 3 {
+		t.Fatalf("unexpected slicing %d %d %d", meta.SliceCount(), meta.SliceLength(0), meta.SliceLength(1))
+	}
+	if meta.Header.Get("Content-Type") != "application/x-steam-chunk" {
+		t.Fatalf("header not stored: %v", meta.Header)
+	}
+
+	download, _ := store.JoinDownload(key, 1)
+	err = download.Begin(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = download.Write([]byte("rld"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.OpenSlice(key, 1); !os.IsNotExist(err) {
+		t.Fatalf("uncommitted slice must not be visible, got %v", err)
+	}
+	err = download.Commit(meta.SliceLength(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := store.OpenSlice(key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	body, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "rld" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if _, err = store.OpenSlice(key, 0); !os.IsNotExist(err) {
+		t.Fatalf("expected missing slice, got %v", err)
+	}
+}
+
+func TestStoreShortSlice(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := Meta{Key: "short", Size: 10, SliceSize: 10}
+	if err = store.WriteMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	download, _ := store.JoinDownload("short", 0)
+	if err = download.Begin(meta); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = download.Write([]byte("abc"))
+	if err = download.Commit(10); err == nil {
+		t.Fatal("short slice should not be committed")
+	}
+	if _, err = store.OpenSlice("short", 0); !os.IsNotExist(err) {
+		t.Fatalf("expected miss, got %v", err)
+	}
+}
+
+func TestStoreTruncatedSlice(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	storeObject(t, store, "steam/truncated", "steam", 42)
+
+	// A power loss left the committed slice without its data
+	if err = os.Truncate(slicePath(store.objectDir("steam/truncated"), 0), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.OpenSlice("steam/truncated", 0); !os.IsNotExist(err) {
+		t.Fatalf("expected miss, got %v", err)
+	}
+	if store.HasSlice("steam/truncated", 0) || store.Size("steam") != 0 {
+		t.Fatal("truncated slice still indexed")
+	}
+	if _, leader := store.JoinDownload("steam/truncated", 0); !leader {
+		t.Fatal("truncated slice not downloaded again")
+	}
+}
@@ -0,0 +1,180 @@
+package http_server
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	http_cache "resolver/cmd/http-cache"
+	lan_cache "resolver/cmd/lan-cache"
+)
+
+// errNotImportable marks nginx cache files that can not be mapped onto this cache
+var errNotImportable = errors.New("not importable")
+
+type importStats struct {
+	files    int
+	slices   int
+	bytes    int64
+	existing int
+	skipped  int
+	failed   int
+}
+
+// ImportNginxCache imports the slices cached by an nginx based lancache from its proxy_cache directory dir.
+// The files are copied, so dir is left untouched.
+func ImportNginxCache(dir string) error {
+	s, err := http_cache.NewStore(http_cache.GetCacheDir())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	rules, err := http_cache.LoadKeyRules()
+	if err != nil {
+		return err
+	}
+
+	serviceOf := func(host string) string {
+		service, _ := lan_cache.GetServiceForDomain(host)
+		return service
+	}
+	stats, err := importNginxCache(s, rules, serviceOf, dir)
+	zap.S().Infof("Imported %d slices (%d bytes) from %d files, %d already cached, %d skipped, %d failed",
+		stats.slices, stats.bytes, stats.files, stats.existing, stats.skipped, stats.failed)
+	return err
+}
+
+func importNginxCache(s *http_cache.Store, rules http_cache.KeyRules, serviceOf func(host string) string, dir string) (importStats, error) {
+	var stats importStats
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		stats.files++
+		err = importNginxCacheFile(s, rules, serviceOf, p, &stats)
+		if errors.Is(err, errNotImportable) {
+			stats.skipped++
+			zap.S().Debugf("Skipping %s (%s)", p, err)
+		} else if err != nil {
+			stats.failed++
+			zap.S().Warnf("Failed to import %s (%s)", p, err)
+		}
+		if stats.files%10000 == 0 {
+			zap.S().Infof("Processed %d files, imported %d slices", stats.files, stats.slices)
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func importNginxCacheFile(s *http_cache.Store, rules http_cache.KeyRules, serviceOf func(host string) string, p string, stats *importStats) error {
+	c, err := http_cache.ParseNginxCacheFile(p)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errNotImportable, err)
+	}
+	k, err := http_cache.ParseLancacheKey(c.Key)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errNotImportable, err)
+	}
+
+	// lancache identifies every host of a service by the service name, only unknown hosts keep their name
+	var service, host string
+	if k.IsHost() {
+		host = k.Identifier
+		service = serviceOf(http_cache.StripPort(host))
+	} else {
+		service = k.Identifier
+	}
+	rule := rules.Rule(service)
+	if rule.IncludeQuery {
+		return fmt.Errorf("%w: keys of %s include the query string", errNotImportable, service)
+	}
+	if rule.IncludeHost && host == "" {
+		return fmt.Errorf("%w: keys of %s include the host", errNotImportable, service)
+	}
+	key := rules.Key(service, host, &url.URL{Path: k.URI})
+
+	var body byteRange
+	var size int64
+	switch c.StatusCode {
+	case http.StatusPartialContent:
+		body, size, err = parseContentRange(c.Header.Get("Content-Range"))
+		if err != nil {
+			return fmt.Errorf("%w: %s", errNotImportable, err)
+		}
+	case http.StatusOK:
+		size = c.BodyLength
+		body = byteRange{start: 0, end: size - 1}
+	default:
+		return fmt.Errorf("%w: status %d", errNotImportable, c.StatusCode)
+	}
+	if body.length() != c.BodyLength {
+		return fmt.Errorf("body has %d bytes, expected %d", c.BodyLength, body.length())
+	}
+
+	meta := http_cache.Meta{
+		Key:       key,
+		Service:   service,
+		Header:    metaHeader(c.Header),
+		Size:      size,
+		SliceSize: http_cache.DefaultSliceSize,
+	}
+	if cached, err := s.ReadMeta(key); err == nil {
+		if cached.Size != meta.Size || cached.Header.Get("ETag") != meta.Header.Get("ETag") {
+			return fmt.Errorf("%w: a different version of %s is cached", errNotImportable, key)
+		}
+		meta = cached
+	} else {
+		err = s.WriteMeta(meta)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := c.Body(f)
+
+	// Only slices completely contained in the file are imported
+	for idx := (body.start + meta.SliceSize - 1) / meta.SliceSize; idx < meta.SliceCount(); idx++ {
+		sliceStart := idx * meta.SliceSize
+		sliceLength := meta.SliceLength(idx)
+		if sliceStart+sliceLength-1 > body.end {
+			break
+		}
+		if s.HasSlice(key, idx) {
+			stats.existing++
+			continue
+		}
+		download, leader := s.JoinDownload(key, idx)
+		if !leader {
+			stats.existing++
+			continue
+		}
+		err = download.Begin(meta)
+		if err == nil {
+			_, err = io.Copy(download, io.NewSectionReader(reader, sliceStart-body.start, sliceLength))
+		}
+		if err == nil {
+			err = download.Commit(sliceLength)
+		} else {
+			download.Abort(err)
+		}
+		if err != nil {
+			return err
+		}
+		stats.slices++
+		stats.bytes += sliceLength
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package http_server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	http_cache "resolver/cmd/http-cache"
+	"testing"
+)
+
+func writeNginxCacheFile(t *testing.T, p string, key string, head string, body []byte) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 336))
+	buf.WriteString("\nKEY: " + key + "\n")
+	buf.WriteString(head)
+	buf.Write(body)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportNginxCache(t *testing.T) {
+	nginxDir := t.TempDir()
+	s, err := http_cache.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	rules, err := http_cache.LoadKeyRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sliceSize := http_cache.DefaultSliceSize
+	size := 2*sliceSize + 10
+	body := bytes.Repeat([]byte("abcdefgh"), int(size/8)+1)[:size]
+	for idx := int64(0); idx < 3; idx++ {
+		start := idx * sliceSize
+		end := start + sliceSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		head := fmt.Sprintf("HTTP/1.1 206 Partial Content\r\nContent-Type: application/x-steam-chunk\r\nETag: \"v1\"\r\nContent-Range: bytes %d-%d/%d\r\nContent-Length: %d\r\n\r\n", start, end, size, end-start+1)
+		key := fmt.Sprintf("steam/depot/431961/chunk/abcbytes=%d-%d", start, start+sliceSize-1)
+		writeNginxCacheFile(t, path.Join(nginxDir, "e", fmt.Sprintf("2%d", idx), fmt.Sprintf("slice%d", idx)), key, head, body[start:end+1])
+	}
+	// Hosts without a service keep their name in the key
+	writeNginxCacheFile(t, path.Join(nginxDir, "f", "00", "other"), "example.com/file.bin",
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", []byte("hello"))
+	// wsus keys include the host, which lancache does not store for service keys
+	writeNginxCacheFile(t, path.Join(nginxDir, "f", "01", "wsus"), "wsus/update.cab",
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", []byte("hello"))
+	if err = os.WriteFile(path.Join(nginxDir, "garbage"), []byte("not a cache file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serviceOf := func(host string) string { return "" }
+	stats, err := importNginxCache(s, rules, serviceOf, nginxDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.slices != 4 || stats.skipped != 2 || stats.failed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	meta, err := s.ReadMeta("steam/depot/431961/chunk/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != size || meta.Service != "steam" || meta.Header.Get("ETag") != `"v1"` || meta.Header.Get("Content-Range") != "" {
+		t.Fatalf("unexpected meta %+v", meta)
+	}
+	var imported []byte
+	for idx := int64(0); idx < meta.SliceCount(); idx++ {
+		f, err := s.OpenSlice(meta.Key, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(f)
+		_ = f.Close()
+		imported = append(imported, b...)
+	}
+	if !bytes.Equal(imported, body) {
+		t.Fatal("imported body differs")
+	}
+	if !s.HasSlice("example.com/file.bin", 0) {
+		t.Fatal("host keyed file not imported")
+	}
+
+	// Importing again does not duplicate anything
+	stats, err = importNginxCache(s, rules, serviceOf, nginxDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.slices != 0 || stats.existing != 4 {
+		t.Fatalf("unexpected stats on second import %+v", stats)
+	}
+}
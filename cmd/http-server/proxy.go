@@ -0,0 +1,105 @@
+package http_server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	recursive_dns_resolver "resolver/cmd/recursive-dns-resolver"
+	"time"
+)
+
+// hopHeaders are only meaningful for a single connection and must not be forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+var upstreamDialer = &net.Dialer{
+	Timeout:   10 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// The system resolver points back at us, so upstream hosts are resolved without applying the redirect list
+var upstreamClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:         dialUpstream,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		// Bodies are stored as they are received, so they must never be transparently decompressed
+		DisableCompression:    true,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func dialUpstream(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.Equal(recursive_dns_resolver.GetOutboundIP()) {
+			return nil, fmt.Errorf("refusing to proxy request to ourselves (%s)", addr)
+		}
+		ips = []string{host}
+	} else {
+		ips, err = recursive_dns_resolver.ResolveDomain(host, false, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no upstream address for %s", host)
+		}
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = upstreamDialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// newUpstreamRequest creates the request sent to the real origin of request
+func newUpstreamRequest(ctx context.Context, request *http.Request) (*http.Request, error) {
+	url := fmt.Sprintf("http://%s%s", request.Host, request.URL.RequestURI())
+	upstreamRequest, err := http.NewRequestWithContext(ctx, request.Method, url, request.Body)
+	if err != nil {
+		return nil, err
+	}
+	upstreamRequest.Header = request.Header.Clone()
+	removeHopHeaders(upstreamRequest.Header)
+	// Cached bodies are served to every client, so they are always fetched without content encoding
+	upstreamRequest.Header.Del("Accept-Encoding")
+	upstreamRequest.Host = request.Host
+	upstreamRequest.ContentLength = request.ContentLength
+	return upstreamRequest, nil
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+}
+
+func copyHeader(dst http.Header, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
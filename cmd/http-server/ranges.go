@@ -0,0 +1,126 @@
+package http_server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+// byteRange is an inclusive range of bytes, as used by the Range and Content-Range headers
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// parseRange parses a Range header for an object of size bytes.
+// ok is false if the whole object should be served, which is the case for missing or malformed headers
+// and for requests of several ranges at once, as permitted by RFC 9110.
+func parseRange(header string, size int64) (r byteRange, ok bool, err error) {
+	if header == "" || !strings.HasPrefix(header, "bytes=") {
+		return byteRange{}, false, nil
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return byteRange{}, false, nil
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return byteRange{}, false, nil
+	}
+	first = strings.TrimSpace(first)
+	last = strings.TrimSpace(last)
+
+	if first == "" {
+		// Suffix range, the last n bytes of the object
+		var n int64
+		n, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return byteRange{}, false, errUnsatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return byteRange{start: size - n, end: size - 1}, true, nil
+	}
+
+	r.start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || r.start < 0 {
+		return byteRange{}, false, nil
+	}
+	r.end = size - 1
+	if last != "" {
+		r.end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || r.end < r.start {
+			return byteRange{}, false, nil
+		}
+		if r.end >= size {
+			r.end = size - 1
+		}
+	}
+	if r.start >= size {
+		return byteRange{}, false, errUnsatisfiable
+	}
+	return r, true, nil
+}
+
+// rangeStart returns the first byte requested by a Range header, without knowing the size of the object
+func rangeStart(header string) int64 {
+	r, ok, err := parseRange(header, 1<<62)
+	if err != nil || !ok || strings.HasPrefix(strings.TrimPrefix(header, "bytes="), "-") {
+		return 0
+	}
+	return r.start
+}
+
+// parseContentRange parses a Content-Range header of a 206 response.
+// size is -1 if the server does not know the size of the object.
+func parseContentRange(header string) (r byteRange, size int64, err error) {
+	spec := strings.TrimPrefix(header, "bytes ")
+	if spec == header {
+		return byteRange{}, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	rng, total, found := strings.Cut(spec, "/")
+	if !found {
+		return byteRange{}, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	first, last, found := strings.Cut(rng, "-")
+	if !found {
+		return byteRange{}, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	r.start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return byteRange{}, 0, err
+	}
+	r.end, err = strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return byteRange{}, 0, err
+	}
+	if r.start > r.end {
+		return byteRange{}, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	if total == "*" {
+		return r, -1, nil
+	}
+	size, err = strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return byteRange{}, 0, err
+	}
+	if r.end >= size {
+		return byteRange{}, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	return r, size, nil
+}
@@ -0,0 +1,53 @@
+package http_server
+
+import (
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		want   byteRange
+		ok     bool
+		err    error
+	}{
+		{"", 100, byteRange{}, false, nil},
+		{"bytes=0-9", 100, byteRange{0, 9}, true, nil},
+		{"bytes=90-", 100, byteRange{90, 99}, true, nil},
+		{"bytes=90-200", 100, byteRange{90, 99}, true, nil},
+		{"bytes=-10", 100, byteRange{90, 99}, true, nil},
+		{"bytes=-200", 100, byteRange{0, 99}, true, nil},
+		{"bytes=100-", 100, byteRange{}, false, errUnsatisfiable},
+		{"bytes=-0", 100, byteRange{}, false, errUnsatisfiable},
+		{"bytes=0-1,5-6", 100, byteRange{}, false, nil},
+		{"bytes=9-1", 100, byteRange{}, false, nil},
+		{"items=0-1", 100, byteRange{}, false, nil},
+	}
+	for _, test := range tests {
+		r, ok, err := parseRange(test.header, test.size)
+		if r != test.want || ok != test.ok || err != test.err {
+			t.Errorf("parseRange(%q, %d) = %v, %v, %v; want %v, %v, %v", test.header, test.size, r, ok, err, test.want, test.ok, test.err)
+		}
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	r, size, err := parseContentRange("bytes 1048576-2097151/5000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.start != 1048576 || r.end != 2097151 || size != 5000000 {
+		t.Fatalf("unexpected %v/%d", r, size)
+	}
+	// The size may be unknown
+	r, size, err = parseContentRange("bytes 0-99/*")
+	if err != nil || r.start != 0 || r.end != 99 || size != -1 {
+		t.Fatalf("unexpected %v/%d (%v)", r, size, err)
+	}
+	for _, invalid := range []string{"", "bytes */100", "bytes */*", "bytes 5-1/100", "bytes 5-1/*", "bytes 0-100/100", "0-1/2"} {
+		if _, _, err = parseContentRange(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
@@ -2,25 +2,60 @@ package http_server
 
 import (
 	"go.uber.org/zap"
+	"io"
 	"net/http"
-	recursive_dns_resolver "resolver/cmd/recursive-dns-resolver"
+	http_cache "resolver/cmd/http-cache"
+	lan_cache "resolver/cmd/lan-cache"
+	"sync"
 )
 
+var store *http_cache.Store
+var keyRules http_cache.KeyRules
+
+// storeMu guards opening and closing the store, requests only use it in between
+var storeMu sync.Mutex
+
 func Start() {
+	storeMu.Lock()
+	var err error
+	store, err = http_cache.NewStore(http_cache.GetCacheDir())
+	storeMu.Unlock()
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	keyRules, err = http_cache.LoadKeyRules()
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	evictionConfig, err := http_cache.LoadEvictionConfig()
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	go store.RunEviction(evictionConfig)
+
 	http.HandleFunc("/", httpHandler)
-	err := http.ListenAndServe(":80", nil)
+	err = http.ListenAndServe(":80", nil)
 	if err != nil {
 		zap.S().Fatal(err)
 	}
 }
 
+// Stop writes the access history of the cache to disk and closes it
+func Stop() error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if store == nil {
+		return nil
+	}
+	return store.Close()
+}
+
 func httpHandler(responseWriter http.ResponseWriter, request *http.Request) {
 	origin := request.Host
 	origin += request.URL.Path
-	zap.S().Infof("Origin: %s", origin)
-	zap.S().Infof("Header: %s", request.Header)
-	zap.S().Infof("Body: %s", request.Body)
-	zap.S().Infof("Method: %s", request.Method)
+	zap.S().Debugf("Origin: %s", origin)
+	zap.S().Debugf("Header: %s", request.Header)
+	zap.S().Debugf("Method: %s", request.Method)
 	/*
 		{"log.level":"info","@timestamp":"2022-08-26T15:57:43.312+0200","log.origin":{"file.name":"http-server/server.go","file.line":19},"message":"Origin: cache8-fra1.steamcontent.com/depot/431961/manifest/2239709941380521483/5/6181091970455626236","ecs.version":"1.6.0"}
 		{"log.level":"info","@timestamp":"2022-08-26T15:57:43.312+0200","log.origin":{"file.name":"http-server/server.go","file.line":20},"message":"Header: map[Accept:[text/html,**;q=0.9] Accept-Charset:[ISO-8859-1,utf-8,*;q=0.7] Accept-Encoding:[gzip,identity,*;q=0] User-Agent:[Valve/Steam HTTP Client 1.0] X-Steam-Proxy:[LANCache]]","ecs.version":"1.6.0"}
@@ -28,10 +63,44 @@ func httpHandler(responseWriter http.ResponseWriter, request *http.Request) {
 		{"log.level":"info","@timestamp":"2022-08-26T15:57:43.313+0200","log.origin":{"file.name":"http-server/server.go","file.line":22},"message":"Method: GET","ecs.version":"1.6.0"}
 	*/
 
-	domain, err := recursive_dns_resolver.ResolveDomain(origin, false, true)
+	if !isCacheable(request) {
+		proxyUncached(responseWriter, request)
+		return
+	}
+	service, _ := lan_cache.GetServiceForDomain(http_cache.StripPort(request.Host))
+	serveSliced(responseWriter, request, service, keyRules.Key(service, request.Host, request.URL))
+}
+
+// isCacheable reports whether the response to request may be served from or stored in the cache
+func isCacheable(request *http.Request) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+	return request.Header.Get("Authorization") == ""
+}
+
+// proxyUncached forwards request to its origin without touching the cache
+func proxyUncached(responseWriter http.ResponseWriter, request *http.Request) {
+	upstreamRequest, err := newUpstreamRequest(request.Context(), request)
+	if err != nil {
+		zap.S().Errorf("Failed to create upstream request for %s (%s)", request.Host, err)
+		responseWriter.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	response, err := upstreamClient.Do(upstreamRequest)
 	if err != nil {
-		zap.S().Error(err)
+		zap.S().Errorf("Failed to fetch %s%s from upstream (%s)", request.Host, request.URL.Path, err)
+		responseWriter.WriteHeader(http.StatusBadGateway)
 		return
 	}
-	zap.S().Infof("Actual domain: %s", domain)
+	defer response.Body.Close()
+
+	removeHopHeaders(response.Header)
+	copyHeader(responseWriter.Header(), response.Header)
+	responseWriter.Header().Set("X-Cache-Status", "BYPASS")
+	responseWriter.WriteHeader(response.StatusCode)
+	_, err = io.Copy(responseWriter, response.Body)
+	if err != nil {
+		zap.S().Debugf("Failed to proxy %s%s (%s)", request.Host, request.URL.Path, err)
+	}
 }
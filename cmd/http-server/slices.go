@@ -0,0 +1,260 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+	http_cache "resolver/cmd/http-cache"
+	"strconv"
+)
+
+// errUncacheable is returned if upstream answers in a way that can not be sliced, for example by ignoring Range
+var errUncacheable = errors.New("upstream response can not be cached")
+
+// errObjectChanged is returned if a slice does not belong to the same version of an object as the cached ones
+var errObjectChanged = errors.New("upstream object changed")
+
+// serveSliced answers request from the cache, downloading all slices of the requested range that are missing
+func serveSliced(responseWriter http.ResponseWriter, request *http.Request, service string, key string) {
+	meta, err := store.ReadMeta(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			zap.S().Warnf("Failed to read cache metadata of %s (%s)", key, err)
+		}
+		// The size of the object is unknown, so the slice holding the first requested byte is fetched to learn it
+		idx := rangeStart(request.Header.Get("Range")) / http_cache.DefaultSliceSize
+		download, leader := store.JoinDownload(key, idx)
+		if leader {
+			startFetch(download, request, idx, &http_cache.Meta{Key: key, Service: service})
+		}
+		meta, err = download.WaitMeta()
+		if err == errUncacheable {
+			zap.S().Infof("Not caching %s (%s)", key, err)
+			proxyUncached(responseWriter, request)
+			return
+		}
+		if err != nil {
+			zap.S().Errorf("Failed to fetch %s from upstream (%s)", key, err)
+			responseWriter.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+
+	r, partial, err := parseRange(request.Header.Get("Range"), meta.Size)
+	if err == errUnsatisfiable {
+		responseWriter.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", meta.Size))
+		responseWriter.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if !partial {
+		r = byteRange{start: 0, end: meta.Size - 1}
+	}
+
+	firstSlice := r.start / meta.SliceSize
+	lastSlice := r.end / meta.SliceSize
+	cacheStatus := "HIT"
+	for idx := firstSlice; idx <= lastSlice && meta.Size > 0; idx++ {
+		if !store.HasSlice(key, idx) {
+			cacheStatus = "MISS"
+			break
+		}
+	}
+	zap.S().Infof("Cache %s for %s (bytes %d-%d/%d)", cacheStatus, key, r.start, r.end, meta.Size)
+	store.Touch(key)
+
+	copyHeader(responseWriter.Header(), meta.Header)
+	responseWriter.Header().Set("Accept-Ranges", "bytes")
+	responseWriter.Header().Set("X-Cache-Status", cacheStatus)
+	if partial {
+		responseWriter.Header().Set("Content-Range", r.contentRange(meta.Size))
+		responseWriter.Header().Set("Content-Length", strconv.FormatInt(r.length(), 10))
+		responseWriter.WriteHeader(http.StatusPartialContent)
+	} else {
+		responseWriter.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+		responseWriter.WriteHeader(http.StatusOK)
+	}
+	if request.Method == http.MethodHead || meta.Size == 0 {
+		return
+	}
+
+	for idx := firstSlice; idx <= lastSlice; idx++ {
+		sliceRange := byteRange{start: idx * meta.SliceSize, end: idx*meta.SliceSize + meta.SliceLength(idx) - 1}
+		if sliceRange.start < r.start {
+			sliceRange.start = r.start
+		}
+		if sliceRange.end > r.end {
+			sliceRange.end = r.end
+		}
+		err = copySlice(responseWriter, request, meta, idx, sliceRange)
+		if err != nil {
+			// The status line is already sent, the only way to signal the failure is dropping the connection
+			zap.S().Warnf("Failed to serve slice %d of %s to %s (%s)", idx, key, request.RemoteAddr, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// copySlice writes the bytes r of slice idx to w.
+// Missing slices are downloaded, or followed if another request is already downloading them.
+func copySlice(w io.Writer, request *http.Request, meta http_cache.Meta, idx int64, r byteRange) error {
+	offset := r.start - idx*meta.SliceSize
+
+	f, err := store.OpenSlice(meta.Key, idx)
+	if err == nil {
+		defer f.Close()
+		_, err = io.Copy(w, io.NewSectionReader(f, offset, r.length()))
+		return err
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	download, leader := store.JoinDownload(meta.Key, idx)
+	if leader {
+		startFetch(download, request, idx, &meta)
+	}
+	reader, err := download.NewReader(offset)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.CopyN(w, reader, r.length())
+	return err
+}
+
+// startFetch downloads slice idx in the background, so it completes for all waiting clients
+// even if the client that started it goes away.
+// meta is the cached metadata of the object, or only holds its key and service if it is not cached yet.
+func startFetch(download *http_cache.Download, request *http.Request, idx int64, meta *http_cache.Meta) {
+	sliceSize := meta.SliceSize
+	if sliceSize == 0 {
+		sliceSize = http_cache.DefaultSliceSize
+	}
+	start := idx * sliceSize
+	upstreamRequest, err := newSliceRequest(request, byteRange{start: start, end: start + sliceSize - 1})
+	if err != nil {
+		download.Abort(err)
+		return
+	}
+
+	go func() {
+		err := fetchSlice(download, upstreamRequest, idx, sliceSize, meta)
+		if err != nil {
+			if err != errUncacheable {
+				zap.S().Warnf("Failed to fetch slice %d of %s (%s)", idx, upstreamRequest.URL, err)
+			}
+			download.Abort(err)
+		}
+	}()
+}
+
+// fetchSlice downloads slice idx of an object from upstream into download.
+// If meta has no slice size the object is not cached yet and its metadata is created from the upstream response,
+// otherwise the response is checked to still belong to the cached version of the object.
+func fetchSlice(download *http_cache.Download, upstreamRequest *http.Request, idx int64, sliceSize int64, meta *http_cache.Meta) error {
+	start := idx * sliceSize
+	response, err := upstreamClient.Do(upstreamRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var size int64
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		var r byteRange
+		r, size, err = parseContentRange(response.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if size < 0 {
+			// Without the size of the object only a short slice tells where it ends
+			if r.end < start+sliceSize-1 {
+				size = r.end + 1
+			} else if meta.SliceSize != 0 {
+				size = meta.Size
+			} else {
+				return errUncacheable
+			}
+		}
+		if r.start != start || (r.end != start+sliceSize-1 && r.end != size-1) {
+			return fmt.Errorf("upstream sent bytes %d-%d for slice %d", r.start, r.end, idx)
+		}
+	case http.StatusOK:
+		// Servers without range support are only cached if the whole object fits into a single slice
+		if idx != 0 || response.ContentLength < 0 || response.ContentLength > sliceSize {
+			return errUncacheable
+		}
+		size = response.ContentLength
+	default:
+		return errUncacheable
+	}
+
+	key := download.Key()
+	newMeta := http_cache.Meta{
+		Key:       key,
+		Service:   meta.Service,
+		Header:    metaHeader(response.Header),
+		Size:      size,
+		SliceSize: sliceSize,
+	}
+	if meta.SliceSize == 0 {
+		err = store.WriteMeta(newMeta)
+		if err != nil {
+			return err
+		}
+	} else {
+		if meta.Size != newMeta.Size || meta.Header.Get("ETag") != newMeta.Header.Get("ETag") {
+			zap.S().Warnf("Object %s changed upstream, dropping it from the cache", key)
+			_ = store.Delete(key)
+			return errObjectChanged
+		}
+		newMeta = *meta
+	}
+
+	err = download.Begin(newMeta)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(download, response.Body)
+	if err != nil {
+		return err
+	}
+	err = download.Commit(newMeta.SliceLength(idx))
+	if err != nil {
+		return err
+	}
+	zap.S().Debugf("Stored slice %d of %s", idx, key)
+	return nil
+}
+
+// newSliceRequest creates the upstream request for the bytes r of the object requested by request
+func newSliceRequest(request *http.Request, r byteRange) (*http.Request, error) {
+	// Not bound to the client request, so the download finishes even if the client disconnects
+	upstreamRequest, err := newUpstreamRequest(context.Background(), request)
+	if err != nil {
+		return nil, err
+	}
+	upstreamRequest.Method = http.MethodGet
+	upstreamRequest.Body = nil
+	upstreamRequest.ContentLength = 0
+	for _, h := range []string{"If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		upstreamRequest.Header.Del(h)
+	}
+	upstreamRequest.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.start, r.end))
+	return upstreamRequest, nil
+}
+
+// metaHeader returns the headers of an upstream response that are stored with the object
+func metaHeader(header http.Header) http.Header {
+	h := header.Clone()
+	removeHopHeaders(h)
+	h.Del("Content-Length")
+	h.Del("Content-Range")
+	h.Del("Date")
+	return h
+}
@@ -0,0 +1,212 @@
+package http_server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	http_cache "resolver/cmd/http-cache"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startSliceTest serves key from a cache in front of upstream, it returns the cache URL and the upstream host
+func startSliceTest(t *testing.T, key string, upstream http.Handler) (string, string) {
+	s, err := http_cache.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStore, oldClient := store, upstreamClient
+	store = s
+	// Upstream is reached directly instead of through the resolver
+	upstreamClient = &http.Client{
+		Transport: &http.Transport{DisableCompression: true},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	upstreamServer := httptest.NewServer(upstream)
+	cacheServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveSliced(w, r, "test", key)
+	}))
+	t.Cleanup(func() {
+		cacheServer.Close()
+		upstreamServer.Close()
+		store, upstreamClient = oldStore, oldClient
+		_ = s.Close()
+	})
+	return cacheServer.URL, strings.TrimPrefix(upstreamServer.URL, "http://")
+}
+
+// fetchCached requests bytes rng of the object at host through the cache
+func fetchCached(t *testing.T, cacheUrl string, host string, rng string) (*http.Response, []byte, error) {
+	request, err := http.NewRequest(http.MethodGet, cacheUrl+"/object", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Host = host
+	// Aborted requests must not be retried on another connection
+	request.Close = true
+	if rng != "" {
+		request.Header.Set("Range", rng)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	return response, body, err
+}
+
+// waitSlice waits for the background download of slice idx to be stored
+func waitSlice(t *testing.T, key string, idx int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !store.HasSlice(key, idx) {
+		if time.Now().After(deadline) {
+			t.Fatalf("slice %d of %s not stored", idx, key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testBody(size int64) []byte {
+	body := make([]byte, size)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+	return body
+}
+
+func TestSlicedUpstreamWithoutRanges(t *testing.T) {
+	body := testBody(100)
+	requests := 0
+	var mu sync.Mutex
+	cacheUrl, host := startSliceTest(t, "test/small", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		// Range is ignored
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		_, _ = w.Write(body)
+	}))
+
+	response, got, err := fetchCached(t, cacheUrl, host, "bytes=10-19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusPartialContent || !bytes.Equal(got, body[10:20]) {
+		t.Fatalf("unexpected %d response %v", response.StatusCode, got)
+	}
+	if response.Header.Get("Content-Range") != "bytes 10-19/100" {
+		t.Fatalf("unexpected headers %v", response.Header)
+	}
+	waitSlice(t, "test/small", 0)
+
+	response, got, err = fetchCached(t, cacheUrl, host, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || !bytes.Equal(got, body) || response.Header.Get("X-Cache-Status") != "HIT" {
+		t.Fatalf("unexpected %d response %v", response.StatusCode, response.Header)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("%d upstream requests", requests)
+	}
+}
+
+func TestSlicedUpstreamWithoutRangesTooLarge(t *testing.T) {
+	body := testBody(http_cache.DefaultSliceSize + 1)
+	cacheUrl, host := startSliceTest(t, "test/large", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		_, _ = w.Write(body)
+	}))
+
+	// Objects of several slices can only be proxied if upstream ignores Range
+	response, got, err := fetchCached(t, cacheUrl, host, "bytes=10-19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || !bytes.Equal(got, body) || response.Header.Get("X-Cache-Status") != "BYPASS" {
+		t.Fatalf("unexpected %d response %v", response.StatusCode, response.Header)
+	}
+	if _, err = store.ReadMeta("test/large"); !os.IsNotExist(err) {
+		t.Errorf("uncacheable object stored (%v)", err)
+	}
+}
+
+func TestSlicedObjectChanged(t *testing.T) {
+	key := "test/changed"
+	body := testBody(2*http_cache.DefaultSliceSize + 10)
+	etag := `"v1"`
+	var mu sync.Mutex
+	cacheUrl, host := startSliceTest(t, key, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		w.Header().Set("ETag", etag)
+		mu.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+
+	response, got, err := fetchCached(t, cacheUrl, host, "bytes=0-9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusPartialContent || !bytes.Equal(got, body[:10]) {
+		t.Fatalf("unexpected %d response %v", response.StatusCode, got)
+	}
+	waitSlice(t, key, 0)
+
+	// The next slice belongs to another version of the object
+	mu.Lock()
+	etag = `"v2"`
+	mu.Unlock()
+	start := http_cache.DefaultSliceSize
+	_, _, err = fetchCached(t, cacheUrl, host, fmt.Sprintf("bytes=%d-%d", start, start+9))
+	if err == nil {
+		t.Fatal("slice of another version served")
+	}
+	if _, err = store.ReadMeta(key); !os.IsNotExist(err) {
+		t.Fatalf("changed object still cached (%v)", err)
+	}
+
+	// The new version is cached from scratch
+	response, got, err = fetchCached(t, cacheUrl, host, fmt.Sprintf("bytes=%d-%d", start, start+9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusPartialContent || !bytes.Equal(got, body[start:start+10]) || response.Header.Get("ETag") != `"v2"` {
+		t.Fatalf("unexpected %d response %v", response.StatusCode, response.Header)
+	}
+	waitSlice(t, key, 1)
+}
+
+func TestSlicedUnknownSize(t *testing.T) {
+	key := "test/unknown"
+	body := testBody(100)
+	cacheUrl, host := startSliceTest(t, key, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/*", len(body)-1))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(body)
+	}))
+
+	response, got, err := fetchCached(t, cacheUrl, host, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || !bytes.Equal(got, body) {
+		t.Fatalf("unexpected %d response %v", response.StatusCode, response.Header)
+	}
+	waitSlice(t, key, 0)
+	meta, err := store.ReadMeta(key)
+	if err != nil || meta.Size != 100 {
+		t.Fatalf("unexpected size %d (%v)", meta.Size, err)
+	}
+}
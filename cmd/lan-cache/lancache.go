@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 )
 import "github.com/go-git/go-git/v5"
@@ -87,14 +88,46 @@ func parseCacheDomainsJson() (CacheDomainsJson, error) {
 	return cdjson, nil
 }
 
+// listMu guards the redirect list and the service lookups built with it,
+// refreshMu makes sure only one caller downloads the cache domains at a time
+var listMu sync.RWMutex
+var refreshMu sync.Mutex
+
 var rdl []string
 var lastUpdate int64
 
+// Domains without wildcard map directly to their service, wildcard domains are matched by suffix
+var serviceDomains map[string]string
+var serviceWildcards []serviceWildcard
+
+type serviceWildcard struct {
+	suffix  string
+	service string
+}
+
+// currentRedirectList returns the redirect list and whether it is younger than 24 hours
+func currentRedirectList() ([]string, bool) {
+	listMu.RLock()
+	defer listMu.RUnlock()
+	return rdl, rdl != nil && lastUpdate != 0 && lastUpdate > (time.Now().Unix()-(24*60*60))
+}
+
 func GetRedirectList() ([]string, error) {
 
 	// If lastUpdate is more than 24 hours ago, download the cache domains json file
-	if rdl != nil && lastUpdate != 0 && lastUpdate > (time.Now().Unix()-(24*60*60)) {
-		return rdl, nil
+	list, fresh := currentRedirectList()
+	if fresh {
+		return list, nil
+	}
+	if list == nil {
+		refreshMu.Lock()
+	} else if !refreshMu.TryLock() {
+		// Another caller is refreshing, the old list is still good enough until then
+		return list, nil
+	}
+	defer refreshMu.Unlock()
+	if list, fresh = currentRedirectList(); fresh {
+		return list, nil
 	}
 
 	err := downloadCacheDomains()
@@ -109,26 +142,62 @@ func GetRedirectList() ([]string, error) {
 	}
 
 	var domains []string
+	exact := make(map[string]string)
+	var wildcards []serviceWildcard
 	for _, domain := range cjd.CacheDomains {
-		if domain.MixedContent {
-			// Not going to handle HTTPS mixed content domains yet
-			continue
-		}
 		for _, domainFile := range domain.DomainFiles {
 			var f []string
 			f, err = readDomainFile(domainFile)
 			if err != nil {
 				return nil, err
 			}
+			for _, s := range f {
+				if strings.Contains(s, "*") {
+					wildcards = append(wildcards, serviceWildcard{suffix: strings.ToLower(strings.Replace(s, "*", "", -1)), service: domain.Name})
+				} else {
+					exact[strings.ToLower(s)] = domain.Name
+				}
+			}
+			// HTTPS traffic of mixed content domains is tunneled by the sni_proxy
 			domains = append(domains, f...)
 		}
 	}
+	listMu.Lock()
 	rdl = domains
+	serviceDomains = exact
+	serviceWildcards = wildcards
 	lastUpdate = time.Now().Unix()
+	listMu.Unlock()
 
 	return domains, nil
 }
 
+// GetServiceForDomain returns the name of the cache_domains service domain belongs to
+func GetServiceForDomain(domain string) (string, bool) {
+	_, err := GetRedirectList()
+	if err != nil {
+		zap.S().Warnf("Failed to get redirect list: %s", err)
+		return "", false
+	}
+	listMu.RLock()
+	exact, wildcards := serviceDomains, serviceWildcards
+	listMu.RUnlock()
+	return lookupService(exact, wildcards, domain)
+}
+
+func lookupService(exact map[string]string, wildcards []serviceWildcard, domain string) (string, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if service, found := exact[domain]; found {
+		return service, true
+	}
+	for _, w := range wildcards {
+		if strings.HasSuffix(domain, w.suffix) {
+			return w.service, true
+		}
+	}
+	return "", false
+}
+
 func readDomainFile(domainfile string) ([]string, error) {
 	cachedir := getCacheDomainsDir()
 	urlFile := path.Join(cachedir, domainfile)
@@ -36,3 +36,22 @@ func TestCreateRedirectList(t *testing.T) {
 	}
 	fmt.Printf("%d domains\n", len(domains))
 }
+
+func TestLookupService(t *testing.T) {
+	exact := map[string]string{"lancache.steamcontent.com": "steam"}
+	wildcards := []serviceWildcard{{suffix: ".steamcontent.com", service: "steam"}, {suffix: ".blizzard.com", service: "blizzard"}}
+
+	tests := map[string]string{
+		"lancache.steamcontent.com.":    "steam",
+		"cache8-fra1.steamcontent.com":  "steam",
+		"CACHE11-FRA1.steamcontent.com": "steam",
+		"level3.blizzard.com":           "blizzard",
+		"example.com":                   "",
+	}
+	for domain, want := range tests {
+		service, found := lookupService(exact, wildcards, domain)
+		if service != want || found != (want != "") {
+			t.Errorf("lookupService(%s) = %s, %v; want %s", domain, service, found, want)
+		}
+	}
+}
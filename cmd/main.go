@@ -1,15 +1,21 @@
 package main
 
 import (
+	"fmt"
 	"go.elastic.co/ecszap"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"net"
 	"os"
+	"os/signal"
 	dns_server "resolver/cmd/dns-server"
 	http_server "resolver/cmd/http-server"
 	lan_cache "resolver/cmd/lan-cache"
+	recursive_dns_resolver "resolver/cmd/recursive-dns-resolver"
 	root_hints "resolver/cmd/root-hints"
+	sni_proxy "resolver/cmd/sni-proxy"
+	trust_anchor "resolver/cmd/trust-anchor"
+	"syscall"
 	"time"
 )
 
@@ -38,9 +44,43 @@ func configureLogger() *zap.Logger {
 	return logger
 }
 
+// runCommand runs one-off maintenance commands instead of the servers
+func runCommand(command string, args []string) {
+	switch command {
+	case "import-nginx":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: resolver import-nginx <proxy_cache directory>")
+			fmt.Fprintln(os.Stderr, "The server has to be stopped first, it keeps the cache locked while running.")
+			os.Exit(2)
+		}
+		err := http_server.ImportNginxCache(args[0])
+		if err != nil {
+			zap.S().Fatal(err)
+		}
+	case "import-root-anchors":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: resolver import-root-anchors <root-anchors.xml>")
+			os.Exit(2)
+		}
+		err := trust_anchor.ImportRootAnchors(args[0])
+		if err != nil {
+			zap.S().Fatal(err)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", command)
+		os.Exit(2)
+	}
+}
+
 func main() {
 	logger := configureLogger()
 	defer logger.Sync()
+
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	_, _, err := root_hints.GetRootServersCached()
 	if err != nil {
 		panic(err)
@@ -55,16 +95,47 @@ func main() {
 		panic("Invalid DNS bind ip")
 	}
 
+	// Keep the DNS cache for the next start, also when stopped while still starting up
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	err = recursive_dns_resolver.LoadCacheSnapshot()
+	if err != nil {
+		zap.S().Warnf("Failed to load DNS cache snapshot (%s)", err)
+	}
+	go recursive_dns_resolver.RunCacheSnapshots()
+	go recursive_dns_resolver.RunStatsLog()
+
 	go dns_server.Start(bidns)
 	go http_server.Start()
+	go sni_proxy.Start()
 
 	for {
 		_, err := lan_cache.GetRedirectList()
 		if err == nil {
 			break
 		}
-		time.Sleep(time.Second)
+		select {
+		case <-signals:
+			shutdown()
+			return
+		case <-time.After(time.Second):
+		}
 	}
 
-	select {}
+	<-signals
+	shutdown()
+}
+
+// shutdown writes the caches to disk
+func shutdown() {
+	err := recursive_dns_resolver.SaveCacheSnapshot()
+	if err != nil {
+		zap.S().Errorf("Failed to save DNS cache snapshot (%s)", err)
+	}
+	// Keep the access history eviction is based on
+	err = http_server.Stop()
+	if err != nil {
+		zap.S().Errorf("Failed to close HTTP cache (%s)", err)
+	}
 }
@@ -0,0 +1,218 @@
+package recursive_dns_resolver
+
+import (
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"os"
+	file_util "resolver/cmd/file-util"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheMinTtl = 0
+	defaultCacheMaxTtl = 86400
+	// defaultCacheMaxNegativeTtl is the upper bound suggested by RFC 2308
+	defaultCacheMaxNegativeTtl = 3600
+	defaultCacheMaxEntries     = 100000
+	defaultCacheMaxSize        = 64 << 20
+	// defaultCacheMaxStale is how long expired results are served, within the 1 to 3 days of RFC 8767
+	defaultCacheMaxStale = 86400
+	// defaultPrefetchHits is how often a result has to be asked for to be prefetched
+	defaultPrefetchHits = 3
+	// staleTtl is the TTL of expired results, as recommended by RFC 8767
+	staleTtl = 30
+	// prefetchWindow is the part of its TTL a popular result is prefetched in before it expires
+	prefetchWindow = 10
+	// refreshRecheck is how long expired results are served stale right away after refreshing them failed,
+	// the failure recheck timer of RFC 8767
+	refreshRecheck = 30 * time.Second
+)
+
+// staleAnswerTimeout is how long an expired result is refreshed before it is served stale,
+// the client response timer of RFC 8767
+var staleAnswerTimeout = 1800 * time.Millisecond
+
+var (
+	domainCacheOnce sync.Once
+	domainCache     *resultCache
+	prefetchHits    int
+)
+
+var (
+	cacheTtlOnce sync.Once
+	cacheMinTtl  uint32
+	cacheMaxTtl  uint32
+	// cacheMaxNegativeTtl bounds the TTL of negative answers, below cacheMaxTtl
+	cacheMaxNegativeTtl uint32
+)
+
+// loadTtl reads a TTL in seconds from the environment variable name
+func loadTtl(name string, def uint32) uint32 {
+	if v, ok := os.LookupEnv(name); ok {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err == nil {
+			return uint32(n)
+		}
+		zap.S().Warnf("Invalid %s %q", name, v)
+	}
+	return def
+}
+
+// cacheTtlLimits returns the bounds all cached TTLs are clamped to, and the upper bound of negative answers,
+// configured by DNS_CACHE_MIN_TTL, DNS_CACHE_MAX_TTL and DNS_CACHE_MAX_NEGATIVE_TTL
+func cacheTtlLimits() (uint32, uint32, uint32) {
+	cacheTtlOnce.Do(func() {
+		cacheMinTtl = loadTtl("DNS_CACHE_MIN_TTL", defaultCacheMinTtl)
+		cacheMaxTtl = loadTtl("DNS_CACHE_MAX_TTL", defaultCacheMaxTtl)
+		if cacheMaxTtl < cacheMinTtl {
+			zap.S().Warnf("DNS_CACHE_MAX_TTL %d is below DNS_CACHE_MIN_TTL %d", cacheMaxTtl, cacheMinTtl)
+			cacheMaxTtl = cacheMinTtl
+		}
+		cacheMaxNegativeTtl = loadTtl("DNS_CACHE_MAX_NEGATIVE_TTL", defaultCacheMaxNegativeTtl)
+		if cacheMaxNegativeTtl > cacheMaxTtl {
+			cacheMaxNegativeTtl = cacheMaxTtl
+		}
+		if cacheMaxNegativeTtl < cacheMinTtl {
+			cacheMaxNegativeTtl = cacheMinTtl
+		}
+	})
+	return cacheMinTtl, cacheMaxTtl, cacheMaxNegativeTtl
+}
+
+// getDomainCache returns the resolver cache, limited by DNS_CACHE_MAX_ENTRIES and DNS_CACHE_MAX_SIZE.
+// DNS_CACHE_MAX_STALE sets how many seconds expired results are served, DNS_CACHE_PREFETCH_HITS
+// how often results have to be asked for to be prefetched. Both are disabled with 0.
+func getDomainCache() *resultCache {
+	domainCacheOnce.Do(func() {
+		maxEntries := defaultCacheMaxEntries
+		if v, ok := os.LookupEnv("DNS_CACHE_MAX_ENTRIES"); ok {
+			n, err := strconv.Atoi(v)
+			if err == nil && n > 0 {
+				maxEntries = n
+			} else {
+				zap.S().Warnf("Invalid DNS_CACHE_MAX_ENTRIES %q", v)
+			}
+		}
+		var maxSize int64 = defaultCacheMaxSize
+		if v, ok := os.LookupEnv("DNS_CACHE_MAX_SIZE"); ok {
+			n, err := file_util.ParseSize(v)
+			if err == nil && n > 0 {
+				maxSize = n
+			} else {
+				zap.S().Warnf("Invalid DNS_CACHE_MAX_SIZE %q", v)
+			}
+		}
+		maxStale := loadTtl("DNS_CACHE_MAX_STALE", defaultCacheMaxStale)
+		prefetchHits = int(loadTtl("DNS_CACHE_PREFETCH_HITS", defaultPrefetchHits))
+		domainCache = newResultCache(maxEntries, maxSize, time.Duration(maxStale)*time.Second)
+	})
+	return domainCache
+}
+
+// cacheGet returns the cached result of q, with TTLs counted down to what remains.
+// Expired results are refreshed first and only served stale when that does not succeed within staleAnswerTimeout,
+// or right away if refreshing them failed recently. Popular results are refreshed shortly before they expire.
+func cacheGet(q dns.Question, opts Options) (*Result, bool) {
+	key := questionKey(q)
+	entry, found := getDomainCache().Get(key)
+	if !found {
+		return nil, false
+	}
+	now := time.Now()
+	if now.After(entry.expires) {
+		if !refreshFailedRecently(key, now) {
+			select {
+			case <-refresh(q, opts):
+				fresh, found := getDomainCache().Get(key)
+				now = time.Now()
+				if found && now.Before(fresh.expires) {
+					return agedResult(fresh.result, now.Sub(fresh.stored)), true
+				}
+			case <-time.After(staleAnswerTimeout):
+				// The refresh keeps running in the background
+			}
+		}
+		zap.S().Debugf("Serving stale %s %s", q.Name, dns.TypeToString[q.Qtype])
+		return copyResult(entry.result, func(uint32) uint32 { return staleTtl }), true
+	}
+	if prefetchHits > 0 && entry.hits >= prefetchHits && entry.expires.Sub(now) < entry.expires.Sub(entry.stored)/prefetchWindow {
+		zap.S().Debugf("Prefetching %s %s", q.Name, dns.TypeToString[q.Qtype])
+		refresh(q, opts)
+	}
+	return agedResult(entry.result, now.Sub(entry.stored)), true
+}
+
+// cacheSet stores result for q, with its TTLs clamped to the configured limits.
+// Negative answers without SOA and bogus answers are not stored. It returns a copy of the result as stored,
+// so callers modifying it do not change the cache.
+func cacheSet(q dns.Question, result *Result) *Result {
+	minTtl, maxTtl, maxNegativeTtl := cacheTtlLimits()
+	if result.Negative() {
+		maxTtl = maxNegativeTtl
+	}
+	result = clampedResult(result, minTtl, maxTtl)
+	ttl := result.TTL()
+	if ttl == 0 || result.bogus {
+		return result
+	}
+	now := time.Now()
+	getDomainCache().Set(questionKey(q), result, now, now.Add(time.Duration(ttl)*time.Second))
+	return copyResult(result, func(ttl uint32) uint32 { return ttl })
+}
+
+// clampedResult returns a copy of r with all TTLs between minTtl and maxTtl
+func clampedResult(r *Result, minTtl uint32, maxTtl uint32) *Result {
+	return copyResult(r, func(ttl uint32) uint32 {
+		if ttl < minTtl {
+			return minTtl
+		}
+		if ttl > maxTtl {
+			return maxTtl
+		}
+		return ttl
+	})
+}
+
+// agedResult returns a copy of r with elapsed subtracted from all TTLs
+func agedResult(r *Result, elapsed time.Duration) *Result {
+	seconds := uint32(elapsed / time.Second)
+	return copyResult(r, func(ttl uint32) uint32 {
+		if ttl < seconds {
+			return 0
+		}
+		return ttl - seconds
+	})
+}
+
+// copyResult returns a deep copy of r, with every TTL replaced by ttl(TTL)
+func copyResult(r *Result, ttl func(uint32) uint32) *Result {
+	c := &Result{
+		Rcode:      r.Rcode,
+		Answer:     copyRecords(r.Answer, ttl),
+		Ns:         copyRecords(r.Ns, ttl),
+		Extra:      copyRecords(r.Extra, ttl),
+		Signatures: copyRecords(r.Signatures, ttl),
+		Secure:     r.Secure,
+		bogus:      r.bogus,
+	}
+	for _, rr := range r.CnameChain {
+		cname := dns.Copy(rr).(*dns.CNAME)
+		cname.Hdr.Ttl = ttl(cname.Hdr.Ttl)
+		c.CnameChain = append(c.CnameChain, cname)
+	}
+	return c
+}
+
+func copyRecords(records []dns.RR, ttl func(uint32) uint32) []dns.RR {
+	if records == nil {
+		return nil
+	}
+	c := make([]dns.RR, len(records))
+	for i, rr := range records {
+		c[i] = dns.Copy(rr)
+		c[i].Header().Ttl = ttl(c[i].Header().Ttl)
+	}
+	return c
+}
@@ -0,0 +1,191 @@
+package recursive_dns_resolver
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func testResult(ttl uint32) *Result {
+	return &Result{
+		Rcode: dns.RcodeSuccess,
+		CnameChain: []*dns.CNAME{{
+			Hdr:    dns.RR_Header{Name: "www.example.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl * 2},
+			Target: "example.",
+		}},
+		Answer: []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(192, 0, 2, 1),
+		}},
+	}
+}
+
+func TestClampedResult(t *testing.T) {
+	r := testResult(20)
+	clamped := clampedResult(r, 30, 35)
+	if clamped.Answer[0].Header().Ttl != 30 || clamped.CnameChain[0].Hdr.Ttl != 35 {
+		t.Fatalf("TTLs not clamped: %s %s", clamped.CnameChain[0], clamped.Answer[0])
+	}
+	if r.Answer[0].Header().Ttl != 20 {
+		t.Fatal("original result modified")
+	}
+	if clamped.TTL() != 30 {
+		t.Fatalf("expected result TTL 30, got %d", clamped.TTL())
+	}
+}
+
+func TestCacheCountsDown(t *testing.T) {
+	q := dns.Question{Name: "example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	stored := time.Now().Add(-100 * time.Second)
+	getDomainCache().Set(questionKey(q), testResult(300), stored, stored.Add(300*time.Second))
+	defer getDomainCache().Delete(questionKey(q))
+
+	r, found := cacheGet(q, Options{})
+	if !found {
+		t.Fatal("result not cached")
+	}
+	if r.Answer[0].Header().Ttl != 200 || r.CnameChain[0].Hdr.Ttl != 500 {
+		t.Fatalf("TTLs not counted down: %s %s", r.CnameChain[0], r.Answer[0])
+	}
+
+	aged := agedResult(r, time.Hour)
+	if aged.TTL() != 0 {
+		t.Fatalf("expired TTL should be 0, got %d", aged.TTL())
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.",
+		Mbox:   "hostmaster.example.",
+		Minttl: 300,
+	}
+	ns := []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: "ns.example."}, soa}
+
+	r := &Result{Rcode: dns.RcodeNameError, Ns: negativeAuthority(".", ns)}
+	if len(r.Ns) != 1 || r.TTL() != 300 || soa.Hdr.Ttl != 3600 {
+		t.Fatalf("expected only the SOA with its minimum as TTL, got %v", r.Ns)
+	}
+
+	q := dns.Question{Name: "missing.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	cacheSet(q, r)
+	defer getDomainCache().Delete(questionKey(q))
+	cached, found := cacheGet(q, Options{})
+	if !found || cached.Rcode != dns.RcodeNameError || len(cached.Ns) != 1 {
+		t.Fatalf("NXDOMAIN not cached: %v", cached)
+	}
+
+	// Without SOA nobody knows how long the answer is valid
+	q = dns.Question{Name: "nodata.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	cacheSet(q, &Result{Rcode: dns.RcodeSuccess})
+	if _, found = cacheGet(q, Options{}); found {
+		t.Fatal("NODATA without SOA cached")
+	}
+}
+
+func TestCacheSetCopies(t *testing.T) {
+	q := dns.Question{Name: "copied.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	r := cacheSet(q, testResult(300))
+	defer getDomainCache().Delete(questionKey(q))
+
+	// The caller owns the returned result
+	r.Answer[0].Header().Ttl = 1
+	ip := r.Answer[0].(*dns.A).A
+	ip[len(ip)-1] = 99
+	r.CnameChain = nil
+	r.Rcode = dns.RcodeServerFailure
+
+	cached, found := cacheGet(q, Options{})
+	if !found {
+		t.Fatal("result not cached")
+	}
+	if cached.Rcode != dns.RcodeSuccess || len(cached.CnameChain) != 1 || cached.Answer[0].Header().Ttl < 299 ||
+		!cached.Answer[0].(*dns.A).A.Equal(testResult(300).Answer[0].(*dns.A).A) {
+		t.Fatalf("cached result changed by the caller: %v", cached)
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	q := dns.Question{Name: "stale.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	// Pretend the refresh is running already and does not finish, so none is started
+	refreshing.Store(questionKey(q), make(chan struct{}))
+	defer refreshing.Delete(questionKey(q))
+	defer func(timeout time.Duration) { staleAnswerTimeout = timeout }(staleAnswerTimeout)
+	staleAnswerTimeout = 10 * time.Millisecond
+
+	stored := time.Now().Add(-400 * time.Second)
+	getDomainCache().Set(questionKey(q), testResult(300), stored, stored.Add(300*time.Second))
+	defer getDomainCache().Delete(questionKey(q))
+
+	r, found := cacheGet(q, Options{})
+	if !found {
+		t.Fatal("expired result not served")
+	}
+	if r.Answer[0].Header().Ttl != staleTtl || r.TTL() != staleTtl {
+		t.Fatalf("expected stale TTL %d, got %d", staleTtl, r.TTL())
+	}
+
+	c := newResultCache(100, 1<<20, time.Minute)
+	key := questionKey(q)
+	c.Set(key, testResult(300), stored, time.Now().Add(-2*time.Minute))
+	if _, found = c.Get(key); found {
+		t.Fatal("result served after the stale period")
+	}
+}
+
+func TestStaleRefreshedFirst(t *testing.T) {
+	q := dns.Question{Name: "refreshed.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	key := questionKey(q)
+	// Pretend a refresh is running, which stores a fresh result
+	done := make(chan struct{})
+	refreshing.Store(key, done)
+	defer refreshing.Delete(key)
+
+	stored := time.Now().Add(-400 * time.Second)
+	getDomainCache().Set(key, testResult(300), stored, stored.Add(300*time.Second))
+	defer getDomainCache().Delete(key)
+	go func() {
+		now := time.Now()
+		getDomainCache().Set(key, testResult(300), now, now.Add(300*time.Second))
+		close(done)
+	}()
+
+	r, found := cacheGet(q, Options{})
+	if !found {
+		t.Fatal("result not served")
+	}
+	if r.TTL() == staleTtl || r.TTL() < 290 {
+		t.Fatalf("stale result served instead of the refreshed one, TTL %d", r.TTL())
+	}
+}
+
+func TestStaleAfterFailedRefresh(t *testing.T) {
+	q := dns.Question{Name: "unreachable.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	key := questionKey(q)
+	stored := time.Now().Add(-400 * time.Second)
+	getDomainCache().Set(key, testResult(300), stored, stored.Add(300*time.Second))
+	defer getDomainCache().Delete(key)
+	defer refreshFailures.Delete(key)
+
+	// Upstream fails
+	<-startRefresh(key, func() error { return errors.New("upstream unreachable") })
+
+	// Until the failure is rechecked, stale results are served without waiting for another refresh
+	start := time.Now()
+	r, found := cacheGet(q, Options{})
+	if !found || r.TTL() != staleTtl {
+		t.Fatal("stale result not served")
+	}
+	if elapsed := time.Since(start); elapsed >= staleAnswerTimeout/2 {
+		t.Fatalf("waited %s for a refresh", elapsed)
+	}
+	if _, running := refreshing.Load(key); running {
+		t.Fatal("refresh started within the failure recheck time")
+	}
+	if !refreshFailedRecently(key, time.Now()) || refreshFailedRecently(key, time.Now().Add(refreshRecheck)) {
+		t.Fatal("failure not rechecked after refreshRecheck")
+	}
+}
@@ -0,0 +1,650 @@
+package recursive_dns_resolver
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"os"
+	trust_anchor "resolver/cmd/trust-anchor"
+	"strings"
+	"sync"
+	"time"
+)
+
+// security is the DNSSEC state of data, as in RFC 4035 section 4.3
+type security int
+
+const (
+	securityInsecure security = iota
+	securitySecure
+	securityBogus
+)
+
+const (
+	// maxNsec3Iterations is the limit of RFC 9276, zones using more iterations are treated as insecure
+	maxNsec3Iterations = 150
+	// bogusKeysTtl is how long zones whose keys failed validation are not asked again
+	bogusKeysTtl = time.Minute
+	// maxZoneKeysTtl bounds how long validated keys are kept, the trust anchors included
+	maxZoneKeysTtl = 24 * time.Hour
+	// maxTrackedZones bounds the key cache, expired zones are dropped beyond it
+	maxTrackedZones = 10000
+)
+
+var ErrBogus = errors.New("DNSSEC validation failed")
+
+var (
+	dnssecOnce           sync.Once
+	dnssecEnabled        bool
+	negativeTrustAnchors []string
+)
+
+// loadDnssecConfig reads DNSSEC_VALIDATION, which disables validation when off,
+// and DNSSEC_NTA, a comma separated list of domains whose answers are not validated
+func loadDnssecConfig() {
+	dnssecOnce.Do(func() {
+		dnssecEnabled = true
+		if v, ok := os.LookupEnv("DNSSEC_VALIDATION"); ok {
+			switch strings.ToLower(v) {
+			case "off", "false", "0":
+				dnssecEnabled = false
+			case "on", "true", "1":
+			default:
+				zap.S().Warnf("Invalid DNSSEC_VALIDATION %q", v)
+			}
+		}
+		if v, ok := os.LookupEnv("DNSSEC_NTA"); ok {
+			for _, domain := range strings.Split(v, ",") {
+				domain = strings.TrimSpace(domain)
+				if domain != "" {
+					negativeTrustAnchors = append(negativeTrustAnchors, strings.ToLower(dns.Fqdn(domain)))
+				}
+			}
+		}
+	})
+}
+
+// validationDisabled reports whether records of name are not validated,
+// because validation is off or name is covered by a negative trust anchor
+func validationDisabled(name string) bool {
+	loadDnssecConfig()
+	if !dnssecEnabled {
+		return true
+	}
+	for _, nta := range negativeTrustAnchors {
+		if dns.IsSubDomain(nta, name) {
+			return true
+		}
+	}
+	return false
+}
+
+type zoneKeysEntry struct {
+	keys    []*dns.DNSKEY
+	sec     security
+	expires time.Time
+}
+
+var (
+	zoneKeysMu    sync.Mutex
+	zoneKeysCache = make(map[string]zoneKeysEntry)
+)
+
+// zoneKeys returns the validated DNSKEYs of zone, found through the chain of DS records from the root.
+// Zones below an insecure delegation are insecure and have no keys.
+func zoneKeys(zone string, res *resolution) ([]*dns.DNSKEY, security, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if validationDisabled(zone) {
+		return nil, securityInsecure, nil
+	}
+
+	now := time.Now()
+	zoneKeysMu.Lock()
+	entry, ok := zoneKeysCache[zone]
+	zoneKeysMu.Unlock()
+	if ok && now.Before(entry.expires) {
+		if entry.sec == securityBogus {
+			return nil, securityBogus, fmt.Errorf("%w: keys of %s", ErrBogus, zone)
+		}
+		return entry.keys, entry.sec, nil
+	}
+
+	keys, sec, ttl, err := fetchZoneKeys(zone, res)
+	if err != nil && !errors.Is(err, ErrBogus) {
+		// Failing to get the keys says nothing about them, ask again next time
+		return nil, securityBogus, err
+	}
+	if err != nil {
+		ttl = bogusKeysTtl
+		zap.S().Warnf("Keys of %s are bogus (%s)", zone, err)
+	}
+	if ttl > maxZoneKeysTtl {
+		ttl = maxZoneKeysTtl
+	}
+
+	zoneKeysMu.Lock()
+	if len(zoneKeysCache) >= maxTrackedZones {
+		for z, e := range zoneKeysCache {
+			if now.After(e.expires) {
+				delete(zoneKeysCache, z)
+			}
+		}
+	}
+	zoneKeysCache[zone] = zoneKeysEntry{keys: keys, sec: sec, expires: now.Add(ttl)}
+	zoneKeysMu.Unlock()
+	return keys, sec, err
+}
+
+// fetchZoneKeys returns the keys of zone, validated by the DS records of its parent, and how long they are valid
+func fetchZoneKeys(zone string, res *resolution) ([]*dns.DNSKEY, security, time.Duration, error) {
+	ttl := maxZoneKeysTtl
+	var anchors []*dns.DS
+	if zone == "." {
+		anchors = trust_anchor.GetTrustAnchors()
+	} else {
+		dsResult, err := resolve(dns.Question{Name: zone, Qtype: dns.TypeDS, Qclass: dns.ClassINET}, Options{SkipRedirect: true}, nil, res)
+		if err != nil {
+			return nil, securityBogus, 0, err
+		}
+		ttl = time.Duration(dsResult.TTL()) * time.Second
+		if !dsResult.Secure {
+			return nil, securityInsecure, ttl, nil
+		}
+		for _, rr := range dsResult.Answer {
+			if ds, ok := rr.(*dns.DS); ok {
+				anchors = append(anchors, ds)
+			}
+		}
+		// Without DS zone is only insecure if it is an unsigned delegation, else it is no zone at all
+		// and a signature claiming it as signer is forged
+		if len(anchors) == 0 && (dsResult.Rcode != dns.RcodeSuccess || !provesUnsignedDelegation(dsResult.Ns, zone)) {
+			return nil, securityBogus, 0, fmt.Errorf("%w: %s is not a zone cut", ErrBogus, zone)
+		}
+	}
+	anchors = supportedAnchors(anchors)
+	if len(anchors) == 0 {
+		// Without DS, or only with ones we cannot check, the zone is unsigned as far as we know
+		return nil, securityInsecure, ttl, nil
+	}
+
+	q := dns.Question{Name: zone, Qtype: dns.TypeDNSKEY, Qclass: dns.ClassINET}
+	keyResult, err := resolve(q, Options{SkipRedirect: true, skipValidation: true}, nil, res)
+	if err != nil {
+		return nil, securityBogus, 0, err
+	}
+	var keys []*dns.DNSKEY
+	for _, rr := range keyResult.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, key)
+		}
+	}
+	if keyTtl := time.Duration(keyResult.TTL()) * time.Second; keyTtl < ttl {
+		ttl = keyTtl
+	}
+
+	// A key matching a DS has to sign the DNSKEY RRset
+	now := time.Now()
+	for _, ds := range anchors {
+		for _, key := range keys {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			keyDs := key.ToDS(ds.DigestType)
+			if keyDs == nil || !strings.EqualFold(keyDs.Digest, ds.Digest) {
+				continue
+			}
+			for _, rr := range keyResult.Signatures {
+				sig, ok := rr.(*dns.RRSIG)
+				if !ok || sig.TypeCovered != dns.TypeDNSKEY || sig.KeyTag != key.KeyTag() || sig.Algorithm != key.Algorithm {
+					continue
+				}
+				if sig.ValidityPeriod(now) && sig.Verify(key, keyResult.Answer) == nil {
+					if zone == "." {
+						trust_anchor.Observe(keys, signaturesFor(keyResult.Signatures, ".", dns.TypeDNSKEY))
+					}
+					return keys, securitySecure, ttl, nil
+				}
+			}
+		}
+	}
+	// The unvalidated keys must not be served from the cache
+	getDomainCache().Delete(questionKey(q))
+	return nil, securityBogus, 0, fmt.Errorf("%w: no DNSKEY of %s matches its DS", ErrBogus, zone)
+}
+
+// supportedAnchors returns the DS records whose digest and algorithm can be validated
+func supportedAnchors(anchors []*dns.DS) []*dns.DS {
+	supported := make([]*dns.DS, 0, len(anchors))
+	for _, ds := range anchors {
+		switch ds.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+		default:
+			continue
+		}
+		switch ds.Algorithm {
+		case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+			dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+			supported = append(supported, ds)
+		}
+	}
+	return supported
+}
+
+// verifyRRset checks the signatures of rrset, answered by the servers of zone, with the keys of their signers.
+// The signer has to be the zone containing the RRset, RFC 4035 section 5.3.1. That is zone,
+// or a zone below it hosted by the same servers, which then has to be a proven zone cut.
+// It returns the signature that verified, or whether the signer zone is insecure.
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, zone string, res *resolution) (security, *dns.RRSIG, error) {
+	owner := rrset[0].Header().Name
+	now := time.Now()
+	insecure := false
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(zone, sig.SignerName) || !dns.IsSubDomain(sig.SignerName, owner) {
+			continue
+		}
+		keys, sec, err := zoneKeys(sig.SignerName, res)
+		if err != nil {
+			if !errors.Is(err, ErrBogus) {
+				return securityBogus, nil, err
+			}
+			continue
+		}
+		if sec == securityInsecure {
+			insecure = true
+			continue
+		}
+		for _, key := range keys {
+			if key.Flags&dns.ZONE == 0 || key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if sig.ValidityPeriod(now) && sig.Verify(key, rrset) == nil {
+				return securitySecure, sig, nil
+			}
+		}
+	}
+	if insecure {
+		return securityInsecure, nil, nil
+	}
+	return securityBogus, nil, fmt.Errorf("%w: no valid signature for %s %s", ErrBogus, owner, dns.TypeToString[rrset[0].Header().Rrtype])
+}
+
+// validateResponse validates the records of in that result was built from.
+// zone is the zone of the answering servers, name the owner of the answer after following CNAMEs.
+// Unless final, the answer continues at other servers and only the CNAMEs are validated.
+func validateResponse(in *dns.Msg, q dns.Question, zone string, name string, result *Result, final bool, res *resolution) (security, error) {
+	if validationDisabled(q.Name) || validationDisabled(name) || q.Qtype == dns.TypeRRSIG {
+		// Signatures themselves are not signed
+		return securityInsecure, nil
+	}
+
+	rrsets := make([][]dns.RR, 0)
+	for _, cname := range result.CnameChain {
+		rrsets = append(rrsets, []dns.RR{cname})
+	}
+	rrsets = append(rrsets, groupRRsets(result.Answer)...)
+
+	sec := securitySecure
+	for _, rrset := range rrsets {
+		s, err := validateRRset(in, rrset, zone, res)
+		if err != nil {
+			return securityBogus, err
+		}
+		if s == securityInsecure {
+			sec = securityInsecure
+		}
+	}
+
+	if final && len(result.Answer) == 0 {
+		s, err := validateDenial(in, zone, name, q.Qtype, result.Rcode == dns.RcodeNameError, res)
+		if err != nil {
+			return securityBogus, err
+		}
+		if s == securityInsecure {
+			sec = securityInsecure
+		}
+	}
+	return sec, nil
+}
+
+// validateRRset validates an RRset of the answer section of in
+func validateRRset(in *dns.Msg, rrset []dns.RR, zone string, res *resolution) (security, error) {
+	owner := rrset[0].Header().Name
+	sigs := signaturesFor(in.Answer, owner, rrset[0].Header().Rrtype)
+	if len(sigs) == 0 {
+		return unsignedSecurity(zone, owner, res)
+	}
+	sec, sig, err := verifyRRset(rrset, sigs, zone, res)
+	if err != nil || sec != securitySecure {
+		return sec, err
+	}
+
+	// Records expanded from a wildcard also need proof that their owner does not exist
+	labels := dns.SplitDomainName(owner)
+	if int(sig.Labels) >= len(labels) {
+		return securitySecure, nil
+	}
+	proof, sec, err := validateAuthority(in.Ns, zone, res)
+	if err != nil || sec != securitySecure {
+		return sec, err
+	}
+	nextCloser := dns.Fqdn(strings.Join(labels[len(labels)-int(sig.Labels)-1:], "."))
+	for _, rr := range proof {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if nsecCovers(rr, owner) {
+				return securitySecure, nil
+			}
+		case *dns.NSEC3:
+			if rr.Cover(nextCloser) {
+				return securitySecure, nil
+			}
+		}
+	}
+	return securityBogus, fmt.Errorf("%w: no proof for wildcard answer %s", ErrBogus, owner)
+}
+
+// validateDenial validates the proof in the authority section of in that name has no records of qtype,
+// or does not exist if nxdomain
+func validateDenial(in *dns.Msg, zone string, name string, qtype uint16, nxdomain bool, res *resolution) (security, error) {
+	proof, sec, err := validateAuthority(in.Ns, zone, res)
+	if err != nil || sec == securityInsecure {
+		return sec, err
+	}
+	if len(proof) == 0 {
+		return unsignedSecurity(zone, name, res)
+	}
+	sec = provesDenial(proof, name, qtype, nxdomain)
+	if sec == securityBogus {
+		return sec, fmt.Errorf("%w: no proof that %s %s does not exist", ErrBogus, name, dns.TypeToString[qtype])
+	}
+	return sec, nil
+}
+
+// validateAuthority verifies the signed SOA, NSEC and NSEC3 RRsets of an authority section from the servers of zone
+// and returns them. It is insecure if any of them was signed by an insecure zone.
+func validateAuthority(ns []dns.RR, zone string, res *resolution) ([]dns.RR, security, error) {
+	proof := make([]dns.RR, 0)
+	insecure := false
+	for _, rrset := range groupRRsets(ns) {
+		rrtype := rrset[0].Header().Rrtype
+		if rrtype != dns.TypeSOA && rrtype != dns.TypeNSEC && rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		sigs := signaturesFor(ns, rrset[0].Header().Name, rrtype)
+		if len(sigs) == 0 {
+			continue
+		}
+		sec, _, err := verifyRRset(rrset, sigs, zone, res)
+		if err != nil {
+			return nil, securityBogus, err
+		}
+		if sec == securityInsecure {
+			insecure = true
+			continue
+		}
+		proof = append(proof, rrset...)
+	}
+	if insecure {
+		return nil, securityInsecure, nil
+	}
+	return proof, securitySecure, nil
+}
+
+// unsignedSecurity returns the security of unsigned records of owner, answered by servers of zone.
+// They are only acceptable if zone is insecure, or there is an insecure delegation between zone and owner.
+func unsignedSecurity(zone string, owner string, res *resolution) (security, error) {
+	if validationDisabled(owner) {
+		return securityInsecure, nil
+	}
+	_, sec, err := zoneKeys(zone, res)
+	if err != nil {
+		return securityBogus, err
+	}
+	if sec == securityInsecure {
+		return securityInsecure, nil
+	}
+	if dns.IsSubDomain(zone, owner) {
+		labels := dns.SplitDomainName(owner)
+		for i := len(labels) - dns.CountLabel(zone) - 1; i >= 0; i-- {
+			name := dns.Fqdn(strings.Join(labels[i:], "."))
+			cut, sec, err := delegationSecurity(name, res)
+			if err != nil {
+				return securityBogus, err
+			}
+			if cut && sec == securityInsecure {
+				return securityInsecure, nil
+			}
+		}
+	}
+	return securityBogus, fmt.Errorf("%w: unsigned %s in signed zone %s", ErrBogus, owner, zone)
+}
+
+// delegationSecurity reports whether name is a zone cut, and whether the delegation is secure
+func delegationSecurity(name string, res *resolution) (bool, security, error) {
+	dsResult, err := resolve(dns.Question{Name: name, Qtype: dns.TypeDS, Qclass: dns.ClassINET}, Options{SkipRedirect: true}, nil, res)
+	if err != nil {
+		return false, securityBogus, err
+	}
+	if !dsResult.Secure {
+		return true, securityInsecure, nil
+	}
+	if len(dsResult.Answer) > 0 {
+		return true, securitySecure, nil
+	}
+	if dsResult.Rcode == dns.RcodeNameError {
+		return false, securitySecure, nil
+	}
+	return provesUnsignedDelegation(dsResult.Ns, name), securityInsecure, nil
+}
+
+// provesUnsignedDelegation reports whether the validated proof of a missing DS shows that name is a zone cut
+func provesUnsignedDelegation(proof []dns.RR, name string) bool {
+	for _, rr := range proof {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(rr.Hdr.Name, name) {
+				return hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA)
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) {
+				return hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA)
+			}
+			if rr.Flags&1 == 1 && rr.Cover(name) {
+				// Opt-out ranges may hide unsigned delegations
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// provesDenial checks that the validated NSEC or NSEC3 records prove that name has no records of qtype,
+// or does not exist if nxdomain. NSEC3 opt-out and expensive NSEC3 chains only prove insecurity.
+func provesDenial(proof []dns.RR, name string, qtype uint16, nxdomain bool) security {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range proof {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	if len(nsecs) > 0 && nsecDenial(nsecs, name, qtype, nxdomain) {
+		return securitySecure
+	}
+	if len(nsec3s) > 0 {
+		return nsec3Denial(nsec3s, name, qtype, nxdomain)
+	}
+	return securityBogus
+}
+
+func nsecDenial(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) bool {
+	if !nxdomain {
+		for _, nsec := range nsecs {
+			if strings.EqualFold(nsec.Hdr.Name, name) {
+				return !hasType(nsec.TypeBitMap, qtype) && !hasType(nsec.TypeBitMap, dns.TypeCNAME)
+			}
+		}
+	}
+
+	// The name does not exist if an NSEC covers it, and another one the wildcard at its closest encloser
+	var cover *dns.NSEC
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			cover = nsec
+		}
+	}
+	if cover == nil {
+		return false
+	}
+	if !nxdomain && dns.IsSubDomain(name, cover.NextDomain) {
+		// name is an empty non-terminal, it exists but has no records at all
+		return true
+	}
+	commonLabels := dns.CompareDomainName(name, cover.Hdr.Name)
+	if l := dns.CompareDomainName(name, cover.NextDomain); l > commonLabels {
+		commonLabels = l
+	}
+	labels := dns.SplitDomainName(name)
+	wildcard := dns.Fqdn("*." + strings.Join(labels[len(labels)-commonLabels:], "."))
+	if commonLabels == 0 {
+		wildcard = "*."
+	}
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, wildcard) {
+			return nxdomain
+		}
+		if !nxdomain && strings.EqualFold(nsec.Hdr.Name, wildcard) {
+			return !hasType(nsec.TypeBitMap, qtype) && !hasType(nsec.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+	return false
+}
+
+func nsec3Denial(nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) security {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Iterations > maxNsec3Iterations {
+			return securityInsecure
+		}
+	}
+	if !nxdomain {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(name) {
+				if !hasType(nsec3.TypeBitMap, qtype) && !hasType(nsec3.TypeBitMap, dns.TypeCNAME) {
+					return securitySecure
+				}
+				return securityBogus
+			}
+		}
+	}
+
+	// Closest encloser proof of RFC 5155 section 8.3
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		closestEncloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		matched := false
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(closestEncloser) {
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		}
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		var cover *dns.NSEC3
+		for _, nsec3 := range nsec3s {
+			if nsec3.Cover(nextCloser) {
+				cover = nsec3
+			}
+		}
+		if cover == nil {
+			return securityBogus
+		}
+		if cover.Flags&1 == 1 {
+			// An opt-out range may hide an unsigned delegation
+			return securityInsecure
+		}
+		wildcard := dns.Fqdn("*." + closestEncloser)
+		if closestEncloser == "." {
+			wildcard = "*."
+		}
+		for _, nsec3 := range nsec3s {
+			if nxdomain && nsec3.Cover(wildcard) {
+				return securitySecure
+			}
+			if !nxdomain && nsec3.Match(wildcard) && !hasType(nsec3.TypeBitMap, qtype) && !hasType(nsec3.TypeBitMap, dns.TypeCNAME) {
+				return securitySecure
+			}
+		}
+		return securityBogus
+	}
+	return securityBogus
+}
+
+// nsecCovers reports whether name is between the owner and the next name of nsec in canonical order
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	afterOwner := canonicalCompare(nsec.Hdr.Name, name) < 0
+	beforeNext := canonicalCompare(name, nsec.NextDomain) < 0
+	if canonicalCompare(nsec.Hdr.Name, nsec.NextDomain) < 0 {
+		return afterOwner && beforeNext
+	}
+	// The last NSEC of a zone points back to the apex
+	return afterOwner || beforeNext
+}
+
+// canonicalCompare compares names in the canonical order of RFC 4034 section 6.1
+func canonicalCompare(a string, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// groupRRsets splits records into RRsets of the same owner and type, in order of appearance.
+// RRSIGs are left out.
+func groupRRsets(records []dns.RR) [][]dns.RR {
+	rrsets := make([][]dns.RR, 0)
+	index := make(map[string]int)
+	for _, rr := range records {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", strings.ToLower(rr.Header().Name), rr.Header().Rrtype)
+		i, ok := index[key]
+		if !ok {
+			i = len(rrsets)
+			index[key] = i
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[i] = append(rrsets[i], rr)
+	}
+	return rrsets
+}
+
+// signaturesFor returns the RRSIGs in records covering the RRset of owner and rrtype
+func signaturesFor(records []dns.RR, owner string, rrtype uint16) []*dns.RRSIG {
+	var sigs []*dns.RRSIG
+	for _, rr := range records {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype && strings.EqualFold(sig.Hdr.Name, owner) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
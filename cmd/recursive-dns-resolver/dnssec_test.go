@@ -0,0 +1,283 @@
+package recursive_dns_resolver
+
+import (
+	"crypto"
+	"errors"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCanonicalCompare(t *testing.T) {
+	// The canonical order example of RFC 4034 section 6.1
+	ordered := []string{
+		"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example.",
+	}
+	for i := 0; i < len(ordered)-1; i++ {
+		if canonicalCompare(ordered[i], ordered[i+1]) >= 0 {
+			t.Fatalf("%s should sort before %s", ordered[i], ordered[i+1])
+		}
+	}
+}
+
+func nsec(owner string, next string, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: next,
+		TypeBitMap: append(types, dns.TypeRRSIG, dns.TypeNSEC),
+	}
+}
+
+func TestNsecDenial(t *testing.T) {
+	proof := []dns.RR{
+		nsec("example.", "a.example.", dns.TypeSOA, dns.TypeNS),
+		nsec("a.example.", "c.b.example.", dns.TypeA),
+		nsec("c.b.example.", "example.", dns.TypeNS),
+	}
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		nxdomain bool
+		expected security
+	}{
+		{"a.example.", dns.TypeAAAA, false, securitySecure},
+		{"a.example.", dns.TypeA, false, securityBogus},
+		{"aa.example.", dns.TypeA, true, securitySecure},
+		// The empty non-terminal b.example exists
+		{"b.example.", dns.TypeA, false, securitySecure},
+		// DS of an unsigned delegation
+		{"c.b.example.", dns.TypeDS, false, securitySecure},
+		{"c.b.example.", dns.TypeNS, false, securityBogus},
+	}
+	for _, test := range tests {
+		if sec := provesDenial(proof, test.name, test.qtype, test.nxdomain); sec != test.expected {
+			t.Fatalf("%s %s: expected %d, got %d", test.name, dns.TypeToString[test.qtype], test.expected, sec)
+		}
+	}
+
+	// Without the NSEC covering the wildcard a wildcard might have answered
+	if sec := provesDenial(proof[1:], "aa.example.", dns.TypeA, true); sec != securityBogus {
+		t.Fatalf("NXDOMAIN without wildcard proof accepted")
+	}
+}
+
+func nsec3(name string, zone string, next string, optOut bool, types ...uint16) *dns.NSEC3 {
+	rr := &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(dns.HashName(name, dns.SHA1, 1, "aabb")) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+		Hash:       dns.SHA1,
+		Iterations: 1,
+		SaltLength: 2,
+		Salt:       "aabb",
+		HashLength: 20,
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+	if optOut {
+		rr.Flags = 1
+	}
+	return rr
+}
+
+func TestNsec3Denial(t *testing.T) {
+	// Hashes are ordered, find names whose hashes are around the ones of interest
+	hash := func(name string) string {
+		return dns.HashName(name, dns.SHA1, 1, "aabb")
+	}
+	// An NSEC3 spanning everything but its own hash covers any other name
+	apex := nsec3("example.", "example.", hash("example."), false, dns.TypeSOA, dns.TypeNS)
+	if sec := provesDenial([]dns.RR{apex}, "missing.example.", dns.TypeA, true); sec != securitySecure {
+		t.Fatalf("NXDOMAIN not proven, got %d", sec)
+	}
+	if sec := provesDenial([]dns.RR{apex}, "example.", dns.TypeA, false); sec != securitySecure {
+		t.Fatalf("NODATA not proven, got %d", sec)
+	}
+	if sec := provesDenial([]dns.RR{apex}, "example.", dns.TypeSOA, false); sec != securityBogus {
+		t.Fatalf("existing type denied, got %d", sec)
+	}
+
+	optOut := nsec3("example.", "example.", hash("example."), true, dns.TypeSOA, dns.TypeNS)
+	if sec := provesDenial([]dns.RR{optOut}, "unsigned.example.", dns.TypeDS, false); sec != securityInsecure {
+		t.Fatalf("opt-out should be insecure, got %d", sec)
+	}
+
+	expensive := nsec3("example.", "example.", hash("example."), false, dns.TypeSOA, dns.TypeNS)
+	expensive.Iterations = maxNsec3Iterations + 1
+	if sec := provesDenial([]dns.RR{expensive}, "missing.example.", dns.TypeA, true); sec != securityInsecure {
+		t.Fatalf("expensive NSEC3 should be insecure, got %d", sec)
+	}
+}
+
+// signedZone adds validated keys for zone to the key cache, and returns the private key signing with them
+func signedZone(t *testing.T, zone string) (*dns.DNSKEY, crypto.Signer) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneKeysMu.Lock()
+	zoneKeysCache[zone] = zoneKeysEntry{keys: []*dns.DNSKEY{key}, sec: securitySecure, expires: time.Now().Add(time.Hour)}
+	zoneKeysMu.Unlock()
+	return key, private.(crypto.Signer)
+}
+
+func sign(t *testing.T, key *dns.DNSKEY, private crypto.Signer, rrset []dns.RR) *dns.RRSIG {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		Algorithm:  key.Algorithm,
+		SignerName: key.Hdr.Name,
+		KeyTag:     key.KeyTag(),
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(private, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestVerifyRRset(t *testing.T) {
+	key, private := signedZone(t, "signed.test.")
+	defer func() {
+		zoneKeysMu.Lock()
+		delete(zoneKeysCache, "signed.test.")
+		zoneKeysMu.Unlock()
+	}()
+
+	rrset := []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "www.signed.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(192, 0, 2, 1),
+	}}
+	sig := sign(t, key, private, rrset)
+	res := newResolution()
+
+	sec, _, err := verifyRRset(rrset, []*dns.RRSIG{sig}, "signed.test.", res)
+	if err != nil || sec != securitySecure {
+		t.Fatalf("valid signature rejected (%v)", err)
+	}
+
+	spoofed := []dns.RR{dns.Copy(rrset[0])}
+	spoofed[0].(*dns.A).A = net.IPv4(198, 51, 100, 1)
+	sec, _, err = verifyRRset(spoofed, []*dns.RRSIG{sig}, "signed.test.", res)
+	if !errors.Is(err, ErrBogus) || sec != securityBogus {
+		t.Fatalf("spoofed record accepted")
+	}
+
+	expired := dns.Copy(sig).(*dns.RRSIG)
+	expired.Expiration = uint32(time.Now().Add(-time.Minute).Unix())
+	if _, _, err = verifyRRset(rrset, []*dns.RRSIG{expired}, "signed.test.", res); !errors.Is(err, ErrBogus) {
+		t.Fatalf("expired signature accepted")
+	}
+
+	// A response validates as secure with the signature in the answer section
+	in := new(dns.Msg)
+	in.Answer = []dns.RR{rrset[0], sig}
+	result := &Result{Rcode: dns.RcodeSuccess, Answer: rrset}
+	q := dns.Question{Name: "www.signed.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	sec, err = validateResponse(in, q, "signed.test.", q.Name, result, true, res)
+	if err != nil || sec != securitySecure {
+		t.Fatalf("signed response not secure (%v)", err)
+	}
+}
+
+// cacheMissingDs caches a validated denial of the DS of name, with an NSEC listing types
+func cacheMissingDs(t *testing.T, name string, types ...uint16) {
+	q := dns.Question{Name: name, Qtype: dns.TypeDS, Qclass: dns.ClassINET}
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "signed.test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300}, Ns: "ns.signed.test.", Mbox: "hostmaster.signed.test.", Minttl: 300}
+	cacheSet(q, &Result{Rcode: dns.RcodeSuccess, Ns: []dns.RR{soa, nsec(name, "z."+name, types...)}, Secure: true})
+	t.Cleanup(func() {
+		getDomainCache().Delete(questionKey(q))
+		zoneKeysMu.Lock()
+		delete(zoneKeysCache, name)
+		zoneKeysMu.Unlock()
+	})
+}
+
+func TestForgedSigner(t *testing.T) {
+	signedZone(t, "signed.test.")
+	defer func() {
+		zoneKeysMu.Lock()
+		delete(zoneKeysCache, "signed.test.")
+		zoneKeysMu.Unlock()
+	}()
+	res := newResolution()
+
+	// An attacker signs with its own key, naming the owner as signer, which has no DS as it is no zone
+	forgedKey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "www.signed.test.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := forgedKey.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheMissingDs(t, "www.signed.test.", dns.TypeA)
+	rrset := []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "www.signed.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(203, 0, 113, 66),
+	}}
+	forged := sign(t, forgedKey, private.(crypto.Signer), rrset)
+	sec, _, err := verifyRRset(rrset, []*dns.RRSIG{forged}, "signed.test.", res)
+	if !errors.Is(err, ErrBogus) || sec != securityBogus {
+		t.Fatalf("forged signer accepted as %d (%v)", sec, err)
+	}
+
+	// Signers above the zone of the answering servers are ignored without asking for their keys
+	forged.SignerName = "test."
+	if _, _, err = verifyRRset(rrset, []*dns.RRSIG{forged}, "signed.test.", res); !errors.Is(err, ErrBogus) {
+		t.Fatalf("signer above the zone accepted (%v)", err)
+	}
+
+	// A proven unsigned delegation hosted by the same servers is insecure
+	cacheMissingDs(t, "unsigned.signed.test.", dns.TypeNS)
+	rrset[0].Header().Name = "www.unsigned.signed.test."
+	forged.SignerName = "unsigned.signed.test."
+	sec, _, err = verifyRRset(rrset, []*dns.RRSIG{forged}, "signed.test.", res)
+	if err != nil || sec != securityInsecure {
+		t.Fatalf("unsigned delegation not insecure, got %d (%v)", sec, err)
+	}
+}
+
+func TestNegativeTrustAnchor(t *testing.T) {
+	loadDnssecConfig()
+	negativeTrustAnchors = append(negativeTrustAnchors, "broken.test.")
+	defer func() {
+		negativeTrustAnchors = negativeTrustAnchors[:len(negativeTrustAnchors)-1]
+	}()
+
+	if !validationDisabled("www.broken.test.") || !validationDisabled("broken.test.") {
+		t.Fatal("negative trust anchor ignored")
+	}
+	if validationDisabled("notbroken.test.") {
+		t.Fatal("negative trust anchor applied to another domain")
+	}
+	if _, sec, err := zoneKeys("broken.test.", newResolution()); err != nil || sec != securityInsecure {
+		t.Fatal("zone below negative trust anchor should be insecure")
+	}
+}
+
+func TestResolveDnssec(t *testing.T) {
+	result, err := Resolve(dns.Question{Name: "isc.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, Options{})
+	if err != nil || !result.Secure || len(result.Signatures) == 0 {
+		t.Fatalf("expected secure answer for isc.org, got %v (%v)", result, err)
+	}
+
+	// dnssec-failed.org is deliberately signed with a broken key
+	q := dns.Question{Name: "dnssec-failed.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if _, err = Resolve(q, Options{}); !errors.Is(err, ErrBogus) {
+		t.Fatalf("expected bogus answer, got %v", err)
+	}
+	result, err = Resolve(q, Options{CheckingDisabled: true})
+	if err != nil || result.Secure || len(result.Answer) == 0 {
+		t.Fatalf("expected unvalidated answer with checking disabled, got %v (%v)", result, err)
+	}
+}
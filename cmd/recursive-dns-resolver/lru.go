@@ -0,0 +1,189 @@
+package recursive_dns_resolver
+
+import (
+	"container/list"
+	"github.com/miekg/dns"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheShards spreads the cache over independently locked shards
+const cacheShards = 32
+
+// entryOverhead approximates the memory of an entry besides its records
+const entryOverhead = 200
+
+// cacheKey identifies a cached result, names are lower case
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+func questionKey(q dns.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(dns.Fqdn(q.Name)), qtype: q.Qtype, qclass: q.Qclass}
+}
+
+// cacheEntry is a cached result and the time it was stored, to count down its TTLs
+type cacheEntry struct {
+	key     cacheKey
+	result  *Result
+	stored  time.Time
+	expires time.Time
+	size    int
+	// hits counts the lookups since the entry was stored
+	hits int
+}
+
+type cacheShard struct {
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	// lru holds the entries, most recently used first
+	lru  *list.List
+	size int
+}
+
+// resultCache is a sharded LRU cache of results, bounded by entries and approximate bytes
+type resultCache struct {
+	shards [cacheShards]*cacheShard
+	// maxEntries and maxSize are the limits of each shard
+	maxEntries int
+	maxSize    int
+	// maxStale is how long entries are kept after they expired
+	maxStale time.Duration
+}
+
+// newResultCache creates a cache holding at most maxEntries entries of maxSize bytes in total,
+// keeping expired entries for maxStale
+func newResultCache(maxEntries int, maxSize int64, maxStale time.Duration) *resultCache {
+	c := &resultCache{
+		maxEntries: maxEntries / cacheShards,
+		maxSize:    int(maxSize / cacheShards),
+		maxStale:   maxStale,
+	}
+	if c.maxEntries < 1 {
+		c.maxEntries = 1
+	}
+	if c.maxSize < entryOverhead {
+		c.maxSize = entryOverhead
+	}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{entries: make(map[cacheKey]*list.Element), lru: list.New()}
+	}
+	return c
+}
+
+func (c *resultCache) shard(key cacheKey) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key.name))
+	h.Write([]byte{byte(key.qtype >> 8), byte(key.qtype), byte(key.qclass >> 8), byte(key.qclass)})
+	return c.shards[h.Sum32()%cacheShards]
+}
+
+// Get returns a copy of the entry of key, which may have expired up to maxStale ago
+func (c *resultCache) Get(key cacheKey) (cacheEntry, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires.Add(c.maxStale)) {
+		s.remove(el)
+		return cacheEntry{}, false
+	}
+	entry.hits++
+	s.lru.MoveToFront(el)
+	return *entry, true
+}
+
+// Set stores result under key as stored at stored and valid until expires,
+// evicting the least recently used entries over the limits
+func (c *resultCache) Set(key cacheKey, result *Result, stored time.Time, expires time.Time) {
+	entry := &cacheEntry{key: key, result: result, stored: stored, expires: expires, size: resultSize(key, result)}
+	if entry.size > c.maxSize {
+		return
+	}
+
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok {
+		s.remove(el)
+	}
+	s.entries[key] = s.lru.PushFront(entry)
+	s.size += entry.size
+	for len(s.entries) > c.maxEntries || s.size > c.maxSize {
+		s.remove(s.lru.Back())
+	}
+}
+
+// Delete removes the entry of key
+func (c *resultCache) Delete(key cacheKey) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok {
+		s.remove(el)
+	}
+}
+
+// Len returns the number of entries, including expired ones not evicted yet
+func (c *resultCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += len(s.entries)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Size returns the approximate memory used by the entries in bytes
+func (c *resultCache) Size() int64 {
+	var n int64
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += int64(s.size)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Entries returns copies of all entries, including expired ones not evicted yet
+func (c *resultCache) Entries() []cacheEntry {
+	var entries []cacheEntry
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for el := s.lru.Front(); el != nil; el = el.Next() {
+			entries = append(entries, *el.Value.(*cacheEntry))
+		}
+		s.mu.Unlock()
+	}
+	return entries
+}
+
+// remove has to be called with s.mu held
+func (s *cacheShard) remove(el *list.Element) {
+	entry := s.lru.Remove(el).(*cacheEntry)
+	delete(s.entries, entry.key)
+	s.size -= entry.size
+}
+
+// resultSize approximates the memory used by result, by the wire size of its records
+func resultSize(key cacheKey, result *Result) int {
+	size := entryOverhead + len(key.name)
+	for _, rr := range result.CnameChain {
+		size += dns.Len(rr)
+	}
+	for _, records := range [][]dns.RR{result.Answer, result.Ns, result.Extra, result.Signatures} {
+		for _, rr := range records {
+			size += dns.Len(rr)
+		}
+	}
+	return size
+}
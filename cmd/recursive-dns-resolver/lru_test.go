@@ -0,0 +1,62 @@
+package recursive_dns_resolver
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func TestResultCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newResultCache(2*cacheShards, 1<<20, 0)
+	key := func(i int) cacheKey {
+		return questionKey(dns.Question{Name: fmt.Sprintf("%d.example.", i), Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	}
+
+	for i := 0; i < 1000; i++ {
+		c.Set(key(i), testResult(300), time.Now(), time.Now().Add(time.Minute))
+		if i == 0 {
+			continue
+		}
+		// Keep the first entry in use, so its shard evicts the others
+		if _, ok := c.Get(key(0)); !ok {
+			t.Fatalf("recently used entry evicted after %d entries", i)
+		}
+	}
+	if c.Len() > 2*cacheShards {
+		t.Fatalf("cache holds %d entries, limit is %d", c.Len(), 2*cacheShards)
+	}
+}
+
+func TestResultCacheSizeLimit(t *testing.T) {
+	c := newResultCache(1<<20, cacheShards*2*(entryOverhead+100), 0)
+	for i := 0; i < 1000; i++ {
+		c.Set(questionKey(dns.Question{Name: fmt.Sprintf("%d.example.", i), Qtype: dns.TypeA, Qclass: dns.ClassINET}), testResult(300), time.Now(), time.Now().Add(time.Minute))
+	}
+	if c.Size() > cacheShards*2*(entryOverhead+100) {
+		t.Fatalf("cache uses %d bytes", c.Size())
+	}
+	if c.Len() == 0 {
+		t.Fatal("cache is empty")
+	}
+}
+
+func TestResultCacheKey(t *testing.T) {
+	c := newResultCache(100, 1<<20, 0)
+	c.Set(questionKey(dns.Question{Name: "Example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}), testResult(300), time.Now(), time.Now().Add(time.Minute))
+
+	if _, ok := c.Get(questionKey(dns.Question{Name: "example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})); !ok {
+		t.Fatal("names are case insensitive")
+	}
+	if _, ok := c.Get(questionKey(dns.Question{Name: "example.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})); ok {
+		t.Fatal("types are cached separately")
+	}
+	if _, ok := c.Get(questionKey(dns.Question{Name: "example.", Qtype: dns.TypeA, Qclass: dns.ClassCHAOS})); ok {
+		t.Fatal("classes are cached separately")
+	}
+
+	c.Set(questionKey(dns.Question{Name: "expired.", Qtype: dns.TypeA, Qclass: dns.ClassINET}), testResult(300), time.Now(), time.Now().Add(-time.Second))
+	if _, ok := c.Get(questionKey(dns.Question{Name: "expired.", Qtype: dns.TypeA, Qclass: dns.ClassINET})); ok {
+		t.Fatal("expired entry returned")
+	}
+}
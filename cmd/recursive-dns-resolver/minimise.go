@@ -0,0 +1,133 @@
+package recursive_dns_resolver
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// minimisation is the QNAME minimisation mode of RFC 9156
+type minimisation int
+
+const (
+	minimisationOff minimisation = iota
+	// minimisationRelaxed asks for the full name when a minimised query fails
+	minimisationRelaxed
+	// minimisationStrict never reveals more than the next label, failures of minimised queries are final
+	minimisationStrict
+)
+
+// maxMinimiseCount bounds the minimised queries of a resolution, names with more labels are asked in full
+// below the zone cuts found so far. RFC 9156 section 2.3 suggests 10.
+const maxMinimiseCount = 10
+
+var (
+	minimisationOnce sync.Once
+	minimisationMode minimisation
+)
+
+// getMinimisation returns the mode configured by DNS_QNAME_MINIMISATION, off, relaxed or strict.
+// It defaults to relaxed.
+func getMinimisation() minimisation {
+	minimisationOnce.Do(func() {
+		minimisationMode = minimisationRelaxed
+		if v, ok := os.LookupEnv("DNS_QNAME_MINIMISATION"); ok {
+			switch strings.ToLower(v) {
+			case "off":
+				minimisationMode = minimisationOff
+			case "relaxed":
+			case "strict":
+				minimisationMode = minimisationStrict
+			default:
+				zap.S().Warnf("Invalid DNS_QNAME_MINIMISATION %q", v)
+			}
+		}
+	})
+	return minimisationMode
+}
+
+// MinimisationStats count the minimised queries and how often the full name had to be sent instead
+type MinimisationStats struct {
+	Queries uint64
+	// Fallbacks counts the full queries sent because a minimised one failed, NxdomainFallbacks are included
+	Fallbacks uint64
+	// NxdomainFallbacks counts the minimised queries answered with NXDOMAIN for a name that may exist,
+	// typically by servers not implementing empty non-terminals
+	NxdomainFallbacks uint64
+}
+
+var (
+	minimisedQueries  atomic.Uint64
+	minimiseFallbacks atomic.Uint64
+	nxdomainFallbacks atomic.Uint64
+)
+
+// GetMinimisationStats returns the QNAME minimisation counters since start
+func GetMinimisationStats() MinimisationStats {
+	return MinimisationStats{
+		Queries:           minimisedQueries.Load(),
+		Fallbacks:         minimiseFallbacks.Load(),
+		NxdomainFallbacks: nxdomainFallbacks.Load(),
+	}
+}
+
+// resolveMinimised asks the servers of zone for the ancestors of q.Name, one label more each time, as in RFC 9156.
+// It follows the first referral and returns its result. It returns false when the full name has to be asked of zone,
+// because there is no zone cut before it or, in relaxed mode, a minimised query failed.
+func resolveMinimised(dnsServers []string, zone string, q dns.Question, opts Options, chain []*dns.CNAME, res *resolution) (*Result, bool, error) {
+	mode := getMinimisation()
+	if mode == minimisationOff {
+		return nil, false, nil
+	}
+
+	labels := dns.SplitDomainName(q.Name)
+	for n := dns.CountLabel(zone) + 1; n < len(labels); n++ {
+		if res.minimised >= maxMinimiseCount {
+			return nil, false, nil
+		}
+		res.minimised++
+		minimisedQueries.Add(1)
+
+		// A is the type least likely to confuse servers, see RFC 9156 section 3
+		name := dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+		mq := dns.Question{Name: name, Qtype: dns.TypeA, Qclass: q.Qclass}
+		in, err := queryServers(dnsServers, mq, res)
+		if err == nil && isReferral(in) {
+			var subZone string
+			var subServers []string
+			subZone, subServers, err = delegation(in, zone, name, res)
+			if err == nil {
+				result, err := resolveRecursive(subServers, subZone, q, opts, chain, res)
+				return result, true, err
+			}
+		}
+		if fatal(err) {
+			return nil, true, err
+		}
+
+		if err == nil && in.Rcode == dns.RcodeNameError {
+			// No name exists below a non-existent one, RFC 8020
+			if mode == minimisationStrict {
+				result := &Result{Rcode: dns.RcodeNameError, Ns: negativeAuthority(zone, in.Ns)}
+				result, err = validated(result, in, mq, zone, name, true, opts, res)
+				return result, true, err
+			}
+			nxdomainFallbacks.Add(1)
+			err = fmt.Errorf("NXDOMAIN for %s", name)
+		}
+		if err != nil {
+			if mode == minimisationStrict {
+				return nil, true, err
+			}
+			minimiseFallbacks.Add(1)
+			zap.S().Debugf("Minimised query failed, asking %s for %s (%s)\n", zone, q.Name, err)
+			return nil, false, nil
+		}
+		// The name exists in zone, it is not a zone cut
+	}
+	return nil, false, nil
+}
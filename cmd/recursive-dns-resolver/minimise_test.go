@@ -0,0 +1,144 @@
+package recursive_dns_resolver
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeZone is an authoritative server on port 53 of a loopback address, recording the names it was asked for
+type fakeZone struct {
+	mu    sync.Mutex
+	asked []string
+}
+
+func (z *fakeZone) names() []string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return append([]string{}, z.asked...)
+}
+
+func startFakeZone(t *testing.T, address string, answer func(q dns.Question, r *dns.Msg)) *fakeZone {
+	z := &fakeZone{}
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(address, "53"))
+	if err != nil {
+		t.Skipf("cannot listen on %s:53 (%s)", address, err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		z.mu.Lock()
+		z.asked = append(z.asked, m.Question[0].Name)
+		z.mu.Unlock()
+		r := new(dns.Msg)
+		r.SetReply(m)
+		answer(m.Question[0], r)
+		_ = w.WriteMsg(r)
+	})}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return z
+}
+
+// startFakeHierarchy serves a root zone delegating test. to a zone with www.sub.test, sub.test is an empty non-terminal
+func startFakeHierarchy(t *testing.T, nxdomainForEnt bool) (root *fakeZone, tld *fakeZone) {
+	root = startFakeZone(t, "127.0.0.2", func(q dns.Question, r *dns.Msg) {
+		r.Ns = append(r.Ns, &dns.NS{Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns.test."})
+		r.Extra = append(r.Extra, &dns.A{Hdr: dns.RR_Header{Name: "ns.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(127, 0, 0, 3)})
+	})
+	tld = startFakeZone(t, "127.0.0.3", func(q dns.Question, r *dns.Msg) {
+		r.Authoritative = true
+		soa := &dns.SOA{Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60}, Ns: "ns.test.", Mbox: "hostmaster.test.", Minttl: 60}
+		switch strings.ToLower(q.Name) {
+		case "www.sub.test.":
+			if q.Qtype == dns.TypeA {
+				r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(192, 0, 2, 1)})
+				return
+			}
+		case "sub.test.":
+			if nxdomainForEnt {
+				r.Rcode = dns.RcodeNameError
+			}
+		default:
+			r.Rcode = dns.RcodeNameError
+		}
+		r.Ns = append(r.Ns, soa)
+	})
+	return root, tld
+}
+
+func setMinimisation(t *testing.T, mode minimisation) {
+	minimisationOnce.Do(func() {})
+	previous := minimisationMode
+	minimisationMode = mode
+	t.Cleanup(func() {
+		minimisationMode = previous
+	})
+}
+
+func TestQnameMinimisation(t *testing.T) {
+	setMinimisation(t, minimisationRelaxed)
+	resetServerStats()
+	defer resetServerStats()
+	root, tld := startFakeHierarchy(t, false)
+
+	q := dns.Question{Name: "www.sub.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	result, err := resolveRecursive([]string{"127.0.0.2"}, ".", q, Options{skipValidation: true}, nil, newResolution())
+	if err != nil || len(result.Answer) != 1 {
+		t.Fatalf("expected answer, got %v (%v)", result, err)
+	}
+	if asked := root.names(); len(asked) != 1 || asked[0] != "test." {
+		t.Fatalf("root asked for %v", asked)
+	}
+	if asked := tld.names(); len(asked) != 2 || asked[0] != "sub.test." || asked[1] != "www.sub.test." {
+		t.Fatalf("zone asked for %v", asked)
+	}
+}
+
+func TestQnameMinimisationFallback(t *testing.T) {
+	resetServerStats()
+	defer resetServerStats()
+	_, tld := startFakeHierarchy(t, true)
+	q := dns.Question{Name: "www.sub.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	// The broken NXDOMAIN for the empty non-terminal is ignored in relaxed mode
+	setMinimisation(t, minimisationRelaxed)
+	before := GetMinimisationStats()
+	result, err := resolveRecursive([]string{"127.0.0.2"}, ".", q, Options{skipValidation: true}, nil, newResolution())
+	if err != nil || len(result.Answer) != 1 {
+		t.Fatalf("expected answer, got %v (%v)", result, err)
+	}
+	after := GetMinimisationStats()
+	if after.Fallbacks != before.Fallbacks+1 || after.NxdomainFallbacks != before.NxdomainFallbacks+1 || after.Queries != before.Queries+2 {
+		t.Fatalf("fallback not counted, %+v before and %+v after", before, after)
+	}
+	if asked := tld.names(); asked[len(asked)-1] != "www.sub.test." {
+		t.Fatalf("full name not asked, got %v", asked)
+	}
+
+	// In strict mode it is final
+	setMinimisation(t, minimisationStrict)
+	result, err = resolveRecursive([]string{"127.0.0.2"}, ".", q, Options{skipValidation: true}, nil, newResolution())
+	if err != nil || result.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN, got %v (%v)", result, err)
+	}
+}
+
+func TestQnameMinimisationOff(t *testing.T) {
+	// Without minimisation the full name is sent to every zone
+	setMinimisation(t, minimisationOff)
+	resetServerStats()
+	defer resetServerStats()
+	root, _ := startFakeHierarchy(t, false)
+	q := dns.Question{Name: "www.sub.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if _, err := resolveRecursive([]string{"127.0.0.2"}, ".", q, Options{skipValidation: true}, nil, newResolution()); err != nil {
+		t.Fatal(err)
+	}
+	if asked := root.names(); len(asked) != 1 || asked[0] != "www.sub.test." {
+		t.Fatalf("root asked for %v", asked)
+	}
+}
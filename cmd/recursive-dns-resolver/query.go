@@ -0,0 +1,147 @@
+package recursive_dns_resolver
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueryTimeout   = 1500 * time.Millisecond
+	defaultQueryAttempts  = 3
+	defaultResolveTimeout = 10 * time.Second
+	// defaultMaxQueries matches the limit of recursive queries per client query of BIND
+	defaultMaxQueries = 100
+	// upstreamUdpPayload avoids IP fragmentation, as recommended by DNS flag day 2020
+	upstreamUdpPayload = 1232
+)
+
+var (
+	ErrResolveTimeout = errors.New("resolution deadline exceeded")
+	ErrQueryBudget    = errors.New("too many upstream queries")
+	ErrNoDnsServers   = errors.New("no dns servers")
+)
+
+// queryLimits bound the work done for a single question
+type queryLimits struct {
+	// timeout is the time a nameserver has to answer
+	timeout time.Duration
+	// attempts is the number of nameservers of a zone tried before giving up
+	attempts int
+	// resolveTimeout is the time the whole resolution may take
+	resolveTimeout time.Duration
+	// maxQueries is the number of upstream queries the whole resolution may send
+	maxQueries int
+}
+
+var (
+	queryLimitsOnce sync.Once
+	limits          queryLimits
+)
+
+// getQueryLimits returns the limits configured by DNS_QUERY_TIMEOUT, DNS_QUERY_ATTEMPTS,
+// DNS_RESOLVE_TIMEOUT and DNS_MAX_QUERIES. Timeouts are durations like 1500ms.
+func getQueryLimits() queryLimits {
+	queryLimitsOnce.Do(func() {
+		limits = queryLimits{
+			timeout:        loadDuration("DNS_QUERY_TIMEOUT", defaultQueryTimeout),
+			attempts:       loadCount("DNS_QUERY_ATTEMPTS", defaultQueryAttempts),
+			resolveTimeout: loadDuration("DNS_RESOLVE_TIMEOUT", defaultResolveTimeout),
+			maxQueries:     loadCount("DNS_MAX_QUERIES", defaultMaxQueries),
+		}
+	})
+	return limits
+}
+
+func loadDuration(name string, def time.Duration) time.Duration {
+	if v, ok := os.LookupEnv(name); ok {
+		d, err := time.ParseDuration(v)
+		if err == nil && d > 0 {
+			return d
+		}
+		zap.S().Warnf("Invalid %s %q", name, v)
+	}
+	return def
+}
+
+func loadCount(name string, def int) int {
+	if v, ok := os.LookupEnv(name); ok {
+		n, err := strconv.Atoi(v)
+		if err == nil && n > 0 {
+			return n
+		}
+		zap.S().Warnf("Invalid %s %q", name, v)
+	}
+	return def
+}
+
+// resolution tracks the limits of resolving one question, across CNAMEs and nameserver lookups
+type resolution struct {
+	limits   queryLimits
+	deadline time.Time
+	queries  int
+	// minimised counts the minimised queries, see resolveMinimised
+	minimised int
+}
+
+func newResolution() *resolution {
+	l := getQueryLimits()
+	return &resolution{limits: l, deadline: time.Now().Add(l.resolveTimeout)}
+}
+
+// exchange sends m to the nameserver at server, within the limits of the resolution.
+// It returns the answer and the time it took.
+func (res *resolution) exchange(m *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	remaining := time.Until(res.deadline)
+	if remaining <= 0 {
+		return nil, 0, ErrResolveTimeout
+	}
+	if res.queries >= res.limits.maxQueries {
+		return nil, 0, ErrQueryBudget
+	}
+	res.queries++
+
+	timeout := res.limits.timeout
+	if remaining < timeout {
+		timeout = remaining
+	}
+	c := &dns.Client{Timeout: timeout, UDPSize: upstreamUdpPayload}
+	in, rtt, err := c.Exchange(m, net.JoinHostPort(server, "53"))
+	if err == nil && in.Truncated {
+		// Signed answers often exceed the UDP payload, ask again over TCP
+		c.Net = "tcp"
+		in, rtt, err = c.Exchange(m, net.JoinHostPort(server, "53"))
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", server, err)
+	}
+	return in, rtt, nil
+}
+
+// fatal reports whether err ends the resolution, instead of only the query to one nameserver
+func fatal(err error) bool {
+	return errors.Is(err, ErrResolveTimeout) || errors.Is(err, ErrQueryBudget)
+}
+
+var (
+	rngMu sync.Mutex
+	rng   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// shuffled returns the servers in random order, to spread the load over the nameservers of a zone
+func shuffled(servers []string) []string {
+	s := append([]string{}, servers...)
+	rngMu.Lock()
+	rng.Shuffle(len(s), func(i, j int) {
+		s[i], s[j] = s[j], s[i]
+	})
+	rngMu.Unlock()
+	return s
+}
@@ -0,0 +1,44 @@
+package recursive_dns_resolver
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestResolutionLimits(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+
+	res := &resolution{limits: queryLimits{timeout: time.Second, attempts: 1, maxQueries: 0}, deadline: time.Now().Add(time.Minute)}
+	if _, _, err := res.exchange(m, "192.0.2.1"); !errors.Is(err, ErrQueryBudget) {
+		t.Fatalf("expected query budget error, got %v", err)
+	}
+
+	res = &resolution{limits: queryLimits{timeout: time.Second, attempts: 1, maxQueries: 10}, deadline: time.Now().Add(-time.Second)}
+	if _, _, err := res.exchange(m, "192.0.2.1"); !errors.Is(err, ErrResolveTimeout) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+
+	// A fatal error ends the resolution instead of trying the next server
+	_, err := resolveRecursive([]string{"192.0.2.1", "192.0.2.2"}, ".", m.Question[0], Options{}, nil, res)
+	if !errors.Is(err, ErrResolveTimeout) || res.queries != 0 {
+		t.Fatalf("expected deadline error without queries, got %v after %d queries", err, res.queries)
+	}
+}
+
+func TestShuffled(t *testing.T) {
+	servers := []string{"a", "b", "c", "d"}
+	s := shuffled(servers)
+	if &s[0] == &servers[0] {
+		t.Fatal("servers shuffled in place")
+	}
+	sort.Strings(s)
+	for i := range servers {
+		if s[i] != servers[i] {
+			t.Fatalf("servers changed: %v", s)
+		}
+	}
+}
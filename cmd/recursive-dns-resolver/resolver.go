@@ -1,22 +1,30 @@
 package recursive_dns_resolver
 
 import (
-	"crypto/sha512"
+	"errors"
 	"fmt"
 	"github.com/miekg/dns"
-	"github.com/patrickmn/go-cache"
 	"go.uber.org/zap"
 	"log"
-	"math/rand"
 	"net"
 	lan_cache "resolver/cmd/lan-cache"
 	root_hints "resolver/cmd/root-hints"
 	"strings"
+	"sync"
 	"time"
 )
 
-var domainCacheIpv4 = cache.New(time.Minute*10, time.Minute*10)
-var domainCacheIpv6 = cache.New(time.Minute*10, time.Minute*10)
+const (
+	// redirectTtl is the TTL of the records pointing redirected domains to us
+	redirectTtl = 60
+	// maxCnameChain is the number of CNAMEs followed before giving up
+	maxCnameChain = 8
+)
+
+var (
+	ErrCnameLoop         = errors.New("CNAME loop")
+	ErrCnameChainTooLong = errors.New("CNAME chain too long")
+)
 
 var outboundIp net.IP
 
@@ -36,155 +44,530 @@ func GetOutboundIP() net.IP {
 	return localAddr.IP
 }
 
-func ResolveDomain(domain string, useIpv6 bool, skipRedirect bool) (ip []string, err error) {
-	cacheKeyHasher := sha512.New()
-	cacheKeyHasher.Write([]byte(domain))
-	cacheKey := fmt.Sprintf("%x", cacheKeyHasher.Sum(nil))
+// Options control how a question is resolved
+type Options struct {
+	// SkipRedirect resolves redirected domains to their real addresses instead of to us
+	SkipRedirect bool
+	// CheckingDisabled returns answers that failed DNSSEC validation instead of an error
+	CheckingDisabled bool
+	// skipValidation is used to fetch DNSKEYs, which are validated against the DS of their zone
+	skipValidation bool
+}
 
+// Result is the outcome of resolving a question.
+// Every call returns its own copy, which the caller may modify.
+type Result struct {
+	// Rcode is the response code of the final authoritative answer
+	Rcode int
+	// CnameChain are the CNAME records leading from the asked name to the name the answer belongs to
+	CnameChain []*dns.CNAME
+	// Answer holds the records of the asked type
+	Answer []dns.RR
+	// Ns holds the SOA record of negative answers, its TTL is how long the answer may be cached,
+	// and the NSEC or NSEC3 records proving the denial with their RRSIGs
+	Ns []dns.RR
+	// Extra holds the additional records of the final answer
+	Extra []dns.RR
+	// Signatures are the RRSIGs of the CNAME chain and the answer
+	Signatures []dns.RR
+	// Secure is set if DNSSEC validation proved the whole result authentic
+	Secure bool
+	// bogus marks results that failed validation, which are only returned if checking is disabled
+	bogus bool
+}
+
+// Negative reports whether r states that the name does not exist or has no records of the asked type
+func (r *Result) Negative() bool {
+	return r.Rcode == dns.RcodeNameError || len(r.Answer) == 0
+}
+
+// TTL returns the lowest TTL of the answer, including the CNAME chain.
+// Negative answers are valid as long as their SOA, without SOA they must not be cached.
+func (r *Result) TTL() uint32 {
+	var ttl uint32
+	first := true
+	records := r.Answer
+	if r.Negative() {
+		records = r.Ns
+		if len(records) == 0 {
+			return 0
+		}
+	}
+	for _, rr := range records {
+		if first || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			first = false
+		}
+	}
+	for _, rr := range r.CnameChain {
+		if first || rr.Hdr.Ttl < ttl {
+			ttl = rr.Hdr.Ttl
+			first = false
+		}
+	}
+	return ttl
+}
+
+// ResolveDomain resolves the A or AAAA records of domain, returning the addresses as strings.
+// useIpv6 only selects the record type, the nameservers are queried over the configured transport.
+func ResolveDomain(domain string, useIpv6 bool, skipRedirect bool) (ip []string, err error) {
+	qtype := dns.TypeA
 	if useIpv6 {
-		if ip, found := domainCacheIpv6.Get(cacheKey); found {
-			zap.S().Debugf("Cached")
-			return ip.([]string), nil
+		qtype = dns.TypeAAAA
+	}
+	result, err := Resolve(dns.Question{Name: domain, Qtype: qtype, Qclass: dns.ClassINET}, Options{SkipRedirect: skipRedirect})
+	if err != nil {
+		return nil, err
+	}
+	if result.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s: %s", domain, dns.RcodeToString[result.Rcode])
+	}
+	for _, rr := range result.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = append(ip, rr.A.String())
+		case *dns.AAAA:
+			ip = append(ip, rr.AAAA.String())
 		}
-	} else {
-		if ip, found := domainCacheIpv4.Get(cacheKey); found {
-			zap.S().Debugf("Cached")
-			return ip.([]string), nil
+	}
+	return ip, nil
+}
+
+// Resolve resolves q recursively, starting at the root servers.
+// Only A and AAAA records of redirected domains are rewritten, all other records are returned as received.
+// Names that do not exist are not an error, but a Result with Rcode NXDOMAIN.
+func Resolve(q dns.Question, opts Options) (*Result, error) {
+	return resolve(q, opts, nil, newResolution())
+}
+
+// resolve resolves q, which was reached by following chain, within the limits of res
+func resolve(q dns.Question, opts Options, chain []*dns.CNAME, res *resolution) (*Result, error) {
+	if q.Qclass != dns.ClassINET {
+		return nil, fmt.Errorf("unsupported class %s", dns.ClassToString[q.Qclass])
+	}
+	q.Name = dns.Fqdn(q.Name)
+
+	if !opts.SkipRedirect && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) && isRedirected(q.Name) {
+		if q.Qtype == dns.TypeAAAA {
+			// We only listen on IPv4, clients must not bypass the cache using IPv6
+			return &Result{Rcode: dns.RcodeSuccess}, nil
 		}
+		return &Result{
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: redirectTtl},
+				A:   GetOutboundIP(),
+			}},
+		}, nil
 	}
 
-	if !skipRedirect {
-		redirectList, err := lan_cache.GetRedirectList()
-		if err == nil {
-			for _, s := range redirectList {
-				xdomain := strings.TrimSuffix(domain, ".")
-				if strings.Contains(s, "*") {
-					sx := strings.Replace(s, "*", "", -1)
-					if strings.HasSuffix(domain, sx) {
-						zap.S().Debugf("Domain %s matches redirect (wildcard) %s\n", domain, sx)
-
-						return []string{GetOutboundIP().String()}, nil
-					}
-				} else {
-					if strings.EqualFold(xdomain, s) {
-						zap.S().Debugf("Domain %s matches redirect %s\n", domain, s)
-						return []string{GetOutboundIP().String()}, nil
-					}
-				}
-			}
+	if result, found := cacheGet(q, opts); found {
+		zap.S().Debugf("Cached")
+		return result, nil
+	}
+	return resolveUncached(q, opts, chain, res)
+}
+
+// refreshing holds the cache keys being refreshed in the background, with a channel closed when the refresh is done
+var refreshing sync.Map
+
+// refreshFailures holds when the last refresh of a cache key failed
+var refreshFailures sync.Map
+
+// refresh resolves q in the background to update its cached result, unless that is already happening.
+// The returned channel is closed when the running refresh is done.
+func refresh(q dns.Question, opts Options) <-chan struct{} {
+	return startRefresh(questionKey(q), func() error {
+		_, err := resolveUncached(q, opts, nil, newResolution())
+		if err != nil {
+			zap.S().Warnf("Failed to refresh %s %s (%s)", q.Name, dns.TypeToString[q.Qtype], err)
+		}
+		return err
+	})
+}
+
+// startRefresh runs resolve for key in the background unless it is running already, and records whether it failed
+func startRefresh(key cacheKey, resolve func() error) <-chan struct{} {
+	done := make(chan struct{})
+	if running, loaded := refreshing.LoadOrStore(key, done); loaded {
+		return running.(chan struct{})
+	}
+	go func() {
+		defer close(done)
+		defer refreshing.Delete(key)
+		if err := resolve(); err != nil {
+			refreshFailures.Store(key, time.Now())
 		} else {
-			zap.S().Warnf("Failed to get redirect list: %s", err)
+			refreshFailures.Delete(key)
 		}
+	}()
+	return done
+}
+
+// refreshFailedRecently reports whether the last refresh of key failed less than refreshRecheck ago
+func refreshFailedRecently(key cacheKey, now time.Time) bool {
+	failed, found := refreshFailures.Load(key)
+	if !found {
+		return false
+	}
+	if now.Sub(failed.(time.Time)) >= refreshRecheck {
+		refreshFailures.Delete(key)
+		return false
 	}
+	return true
+}
 
+// resolveUncached resolves q starting at the root servers, and caches the result
+func resolveUncached(q dns.Question, opts Options, chain []*dns.CNAME, res *resolution) (*Result, error) {
 	rootIpv4, rootIpv6, err := root_hints.GetRootServersCached()
 	if err != nil {
 		return nil, err
 	}
-	if useIpv6 {
-		ip, err = resolveRecursive(rootIpv6, domain, useIpv6, skipRedirect)
-	} else {
-		ip, err = resolveRecursive(rootIpv4, domain, useIpv6, skipRedirect)
-	}
+	roots := getTransport().filter(append(append([]string{}, rootIpv4...), rootIpv6...))
+	result, err := resolveRecursive(roots, ".", q, opts, chain, res)
 	if err != nil {
 		return nil, err
 	}
-	if len(ip) > 0 {
-		if useIpv6 {
-			domainCacheIpv6.Set(cacheKey, ip, cache.DefaultExpiration)
+	return cacheSet(q, result), nil
+}
+
+func isRedirected(domain string) bool {
+	redirectList, err := lan_cache.GetRedirectList()
+	if err != nil {
+		zap.S().Warnf("Failed to get redirect list: %s", err)
+		return false
+	}
+	xdomain := strings.TrimSuffix(domain, ".")
+	for _, s := range redirectList {
+		if strings.Contains(s, "*") {
+			sx := strings.Replace(s, "*", "", -1)
+			if strings.HasSuffix(xdomain, sx) {
+				zap.S().Debugf("Domain %s matches redirect (wildcard) %s\n", domain, sx)
+				return true
+			}
 		} else {
-			domainCacheIpv4.Set(cacheKey, ip, cache.DefaultExpiration)
+			if strings.EqualFold(xdomain, s) {
+				zap.S().Debugf("Domain %s matches redirect %s\n", domain, s)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkCnameChain fails if chain is too long or leads back to one of its names
+func checkCnameChain(chain []*dns.CNAME) error {
+	if len(chain) > maxCnameChain {
+		return ErrCnameChainTooLong
+	}
+	seen := make(map[string]bool, len(chain))
+	for _, cname := range chain {
+		seen[strings.ToLower(cname.Hdr.Name)] = true
+		if seen[strings.ToLower(cname.Target)] {
+			return fmt.Errorf("%w at %s", ErrCnameLoop, cname.Target)
 		}
 	}
+	return nil
+}
 
-	return
+// negativeAuthority returns the SOA of the authority section of a negative answer from the servers of zone,
+// and the NSEC and NSEC3 records proving it with their signatures.
+// The SOA TTL is lowered to the SOA minimum, which is the negative TTL as of RFC 2308.
+func negativeAuthority(zone string, ns []dns.RR) []dns.RR {
+	var authority []dns.RR
+	for _, rr := range ns {
+		if !inBailiwick(zone, rr.Header().Name) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			soa := dns.Copy(rr).(*dns.SOA)
+			if soa.Minttl < soa.Hdr.Ttl {
+				soa.Hdr.Ttl = soa.Minttl
+			}
+			authority = append(authority, soa)
+		case *dns.NSEC, *dns.NSEC3:
+			authority = append(authority, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeSOA || rr.TypeCovered == dns.TypeNSEC || rr.TypeCovered == dns.TypeNSEC3 {
+				authority = append(authority, rr)
+			}
+		}
+	}
+	return authority
 }
 
-func resolveRecursive(dnsServers []string, domain string, ipv6 bool, skipRedirect bool) (ip []string, err error) {
+// validated sets whether result is secure, as validated by validateResponse.
+// Results failing validation are an error, unless checking is disabled.
+func validated(result *Result, in *dns.Msg, q dns.Question, zone string, name string, final bool, opts Options, res *resolution) (*Result, error) {
+	if opts.skipValidation {
+		return result, nil
+	}
+	sec, err := validateResponse(in, q, zone, name, result, final, res)
+	if err != nil {
+		if !errors.Is(err, ErrBogus) || !opts.CheckingDisabled {
+			return nil, err
+		}
+		zap.S().Warnf("Returning bogus answer for %s with checking disabled (%s)", q.Name, err)
+		result.bogus = true
+	}
+	result.Secure = sec == securitySecure
+	return result, nil
+}
+
+// resolveRecursive asks dnsServers, the nameservers of zone, for q, trying others if one fails,
+// and follows referrals and CNAMEs until there is an answer
+func resolveRecursive(dnsServers []string, zone string, q dns.Question, opts Options, chain []*dns.CNAME, res *resolution) (*Result, error) {
 	if len(dnsServers) == 0 {
-		return nil, fmt.Errorf("no dns servers")
+		return nil, ErrNoDnsServers
 	}
-	zap.S().Debugf("Resolving %s\n", domain)
+	zap.S().Debugf("Resolving %s %s\n", q.Name, dns.TypeToString[q.Qtype])
 	zap.S().Debugf("Using DNS servers: %s\n", dnsServers)
-	// Pick random server
-	rand.Seed(time.Now().UnixNano())
-	server := dnsServers[rand.Intn(len(dnsServers))]
 
-	m1 := new(dns.Msg)
-	m1.Id = dns.Id()
-	m1.RecursionDesired = false
-	m1.Question = make([]dns.Question, 1)
-	if ipv6 {
-		m1.Question[0] = dns.Question{Name: dns.Fqdn(domain), Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
-	} else {
-		m1.Question[0] = dns.Question{Name: dns.Fqdn(domain), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	minimised, ok, err := resolveMinimised(dnsServers, zone, q, opts, chain, res)
+	if ok || err != nil {
+		return minimised, err
 	}
 
-	c := new(dns.Client)
-	var in *dns.Msg
-	if ipv6 {
-		in, _, err = c.Exchange(m1, fmt.Sprintf("[%s]:53", server))
-	} else {
-		in, _, err = c.Exchange(m1, fmt.Sprintf("%s:53", server))
-	}
+	in, err := queryServers(dnsServers, q, res)
 	if err != nil {
 		return nil, err
 	}
 
-	//	fmt.Printf("%v\n", in)
+	result := &Result{Rcode: in.Rcode}
 
-	if len(in.Answer) > 0 {
-		answers := make([]string, 0)
-		for _, rr := range in.Answer {
-			if ipv6 {
-				if rr.Header().Rrtype == dns.TypeAAAA {
-					answers = append(answers, rr.(*dns.AAAA).AAAA.String())
-				}
-			} else {
-				if rr.Header().Rrtype == dns.TypeA {
-					answers = append(answers, rr.(*dns.A).A.String())
+	// Follow the CNAMEs in the answer, starting at the asked name
+	name := q.Name
+	if q.Qtype != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+		for {
+			var cname *dns.CNAME
+			for _, rr := range in.Answer {
+				if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, name) {
+					cname = c
+					break
 				}
 			}
-			if rr.Header().Rrtype == dns.TypeCNAME {
-				cname := rr.(*dns.CNAME).Target
-				zap.S().Debugf("CNAME %s -> %s\n", domain, cname)
-				return ResolveDomain(cname, ipv6, skipRedirect)
+			if cname == nil {
+				break
+			}
+			zap.S().Debugf("CNAME %s -> %s\n", name, cname.Target)
+			result.CnameChain = append(result.CnameChain, cname)
+			name = cname.Target
+			err = checkCnameChain(append(append([]*dns.CNAME{}, chain...), result.CnameChain...))
+			if err != nil {
+				return nil, err
 			}
+			if !inBailiwick(zone, name) {
+				// The servers of zone are no authority for the target, it is resolved on its own
+				break
+			}
+		}
+	}
+
+	inZone := inBailiwick(zone, name)
+	for _, rr := range in.Answer {
+		if inZone && strings.EqualFold(rr.Header().Name, name) && (rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY) {
+			result.Answer = append(result.Answer, rr)
 		}
-		return answers, nil
-	} else {
-		subServers := make([]string, 0)
+	}
+	for _, cname := range result.CnameChain {
+		for _, sig := range signaturesFor(in.Answer, cname.Hdr.Name, dns.TypeCNAME) {
+			result.Signatures = append(result.Signatures, sig)
+		}
+	}
+	if inZone && q.Qtype != dns.TypeRRSIG && q.Qtype != dns.TypeANY {
+		for _, sig := range signaturesFor(in.Answer, name, q.Qtype) {
+			result.Signatures = append(result.Signatures, sig)
+		}
+	}
+	if len(result.Answer) > 0 {
 		for _, rr := range in.Extra {
-			if ipv6 {
-				if rr.Header().Rrtype == dns.TypeAAAA {
-					subServers = append(subServers, rr.(*dns.AAAA).AAAA.String())
-				}
-			} else {
-				if rr.Header().Rrtype == dns.TypeA {
-					subServers = append(subServers, rr.(*dns.A).A.String())
-				}
+			if rr.Header().Rrtype != dns.TypeOPT && inBailiwick(zone, rr.Header().Name) {
+				result.Extra = append(result.Extra, rr)
 			}
 		}
+		return validated(result, in, q, zone, name, true, opts, res)
+	}
+	if inZone && in.Rcode == dns.RcodeNameError {
+		result.Ns = negativeAuthority(zone, in.Ns)
+		return validated(result, in, q, zone, name, true, opts, res)
+	}
 
-		if len(subServers) == 0 {
-			for _, rr := range in.Ns {
-				if rr.Header().Rrtype == dns.TypeNS {
-					nsDomain := rr.(*dns.NS).Ns
-					var ips []string
-					ips, err = ResolveDomain(nsDomain, false, skipRedirect)
-					if err != nil {
-						zap.S().Debugf("Failed to resolve %s: %s\n", nsDomain, err)
-						continue
-					}
-					subServers = append(subServers, ips...)
-				}
+	if len(result.CnameChain) > 0 {
+		// The records of the CNAME target are elsewhere
+		result, err = validated(result, in, q, zone, name, false, opts, res)
+		if err != nil {
+			return nil, err
+		}
+		var target *Result
+		target, err = resolve(dns.Question{Name: name, Qtype: q.Qtype, Qclass: q.Qclass}, opts,
+			append(append([]*dns.CNAME{}, chain...), result.CnameChain...), res)
+		if err != nil {
+			return nil, err
+		}
+		chained := *target
+		chained.CnameChain = append(result.CnameChain, target.CnameChain...)
+		chained.Signatures = append(result.Signatures, target.Signatures...)
+		chained.Secure = result.Secure && target.Secure
+		chained.bogus = result.bogus || target.bogus
+		return &chained, nil
+	}
+
+	// Without answer the response is either a referral to the servers of a sub zone,
+	// or the authoritative statement that there are no records of this type
+	if !isReferral(in) {
+		result.Ns = negativeAuthority(zone, in.Ns)
+		return validated(result, in, q, zone, name, true, opts, res)
+	}
+
+	subZone, subServers, err := delegation(in, zone, q.Name, res)
+	if err != nil {
+		return nil, err
+	}
+	return resolveRecursive(subServers, subZone, q, opts, chain, res)
+}
+
+// queryServers sends q to the servers of a zone, fastest first, until one answers
+func queryServers(dnsServers []string, q dns.Question, res *resolution) (*dns.Msg, error) {
+	sourcePortsOnce.Do(checkSourcePorts)
+	mixedCase := useCaseRandomisation()
+
+	m1 := new(dns.Msg)
+	m1.RecursionDesired = false
+	// Ask for signatures, to validate them
+	m1.SetEdns0(upstreamUdpPayload, true)
+
+	var in *dns.Msg
+	var err error
+	servers := orderServers(dnsServers)
+	if len(servers) > res.limits.attempts {
+		servers = servers[:res.limits.attempts]
+	}
+	for _, server := range servers {
+		// A spoofed answer has to guess the ID, the source port and with 0x20 the case of the name
+		sent := q
+		if mixedCase {
+			sent.Name = randomiseCase(q.Name)
+		}
+		m1.Question = []dns.Question{sent}
+		m1.Id = queryId()
+		var rtt time.Duration
+		in, rtt, err = res.exchange(m1, server)
+		if fatal(err) {
+			return nil, err
+		}
+		if err == nil {
+			err = checkResponse(sent, in, mixedCase)
+		}
+		if err == nil && in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("%s answered %s for %s", server, dns.RcodeToString[in.Rcode], q.Name)
+		}
+		if err == nil {
+			if mixedCase {
+				restoreCase(in, q.Name)
 			}
+			recordSuccess(server, rtt)
+			return in, nil
 		}
+		recordFailure(server)
+		zap.S().Debugf("Failed to query %s (%s)\n", server, err)
+	}
+	return nil, err
+}
 
-		ip, err = resolveRecursive(subServers, domain, ipv6, false)
-		if err != nil {
+// isReferral reports whether in delegates to the servers of a sub zone
+func isReferral(in *dns.Msg) bool {
+	if in.Authoritative || len(in.Answer) > 0 || in.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	for _, rr := range in.Ns {
+		if rr.Header().Rrtype == dns.TypeNS {
+			return true
+		}
+	}
+	return false
+}
+
+// delegation returns the sub zone a referral from the servers of zone for name points to,
+// and the addresses of its servers. Only glue for nameservers within zone is used.
+func delegation(in *dns.Msg, zone string, name string, res *resolution) (string, []string, error) {
+	var subZone string
+	for _, rr := range in.Ns {
+		if rr.Header().Rrtype == dns.TypeNS {
+			subZone = strings.ToLower(rr.Header().Name)
+			break
+		}
+	}
+	if !inBailiwick(zone, subZone) || strings.EqualFold(zone, subZone) || !inBailiwick(subZone, name) {
+		return "", nil, fmt.Errorf("%w: referral from %s to %s for %s", ErrOutOfBailiwick, zone, subZone, name)
+	}
+
+	var nameservers []string
+	isNameserver := make(map[string]bool)
+	for _, rr := range in.Ns {
+		if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, subZone) {
+			nameservers = append(nameservers, ns.Ns)
+			isNameserver[strings.ToLower(ns.Ns)] = true
+		}
+	}
+
+	// Glue of both families is used, as far as the transport allows
+	t := getTransport()
+	subServers := make([]string, 0)
+	for _, rr := range in.Extra {
+		owner := rr.Header().Name
+		if !isNameserver[strings.ToLower(owner)] || !inBailiwick(zone, owner) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			if t.allows(rr.A) {
+				subServers = append(subServers, rr.A.String())
+			}
+		case *dns.AAAA:
+			if t.allows(rr.AAAA) {
+				subServers = append(subServers, rr.AAAA.String())
+			}
+		}
+	}
+
+	if len(subServers) == 0 {
+		for _, ns := range nameservers {
+			ips, err := resolveNameserver(ns, t, res)
+			if err != nil {
+				return "", nil, err
+			}
+			subServers = append(subServers, ips...)
+		}
+	}
+	return subZone, subServers, nil
+}
+
+// resolveNameserver returns the addresses of the nameserver ns, of the families the transport allows.
+// Only errors ending the resolution are returned.
+func resolveNameserver(ns string, t transport, res *resolution) ([]string, error) {
+	var ips []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if (qtype == dns.TypeAAAA && !t.ipv6) || (qtype == dns.TypeA && !t.ipv4) {
+			continue
+		}
+		// Nameservers are never redirected to us
+		result, err := resolve(dns.Question{Name: ns, Qtype: qtype, Qclass: dns.ClassINET}, Options{SkipRedirect: true}, nil, res)
+		if fatal(err) {
 			return nil, err
 		}
-		return ip, nil
+		if err != nil {
+			zap.S().Debugf("Failed to resolve %s: %s\n", ns, err)
+			continue
+		}
+		for _, rr := range result.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A.String())
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA.String())
+			}
+		}
 	}
+	return ips, nil
 }
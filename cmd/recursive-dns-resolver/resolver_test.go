@@ -1,6 +1,9 @@
 package recursive_dns_resolver
 
 import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
 	"go.elastic.co/ecszap"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -77,3 +80,76 @@ func TestResolveDomain(t *testing.T) {
 		}
 	}
 }
+
+func TestResolve(t *testing.T) {
+	queries := []dns.Question{
+		{Name: "google.com", Qtype: dns.TypeMX, Qclass: dns.ClassINET},
+		{Name: "google.com", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+		{Name: "google.com", Qtype: dns.TypeNS, Qclass: dns.ClassINET},
+		{Name: "google.com", Qtype: dns.TypeSOA, Qclass: dns.ClassINET},
+		{Name: "google.com", Qtype: dns.TypeCAA, Qclass: dns.ClassINET},
+		{Name: "_xmpp-server._tcp.jabber.org", Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
+		{Name: "8.8.8.8.in-addr.arpa", Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+		{Name: "cloudflare.com", Qtype: dns.TypeHTTPS, Qclass: dns.ClassINET},
+	}
+
+	for _, q := range queries {
+		result, err := Resolve(q, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Rcode != dns.RcodeSuccess || len(result.Answer) == 0 {
+			t.Fatalf("no %s records for %s", dns.TypeToString[q.Qtype], q.Name)
+		}
+		for _, rr := range result.Answer {
+			if rr.Header().Rrtype != q.Qtype {
+				t.Fatalf("unexpected record %s for %s %s", rr, q.Name, dns.TypeToString[q.Qtype])
+			}
+		}
+		zap.S().Infof("%s %s -> %s\n\n", q.Name, dns.TypeToString[q.Qtype], result.Answer)
+	}
+
+	// www.github.com is an alias of github.com
+	result, err := Resolve(dns.Question{Name: "www.github.com", Qtype: dns.TypeA, Qclass: dns.ClassINET}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.CnameChain) == 0 || len(result.Answer) == 0 || result.TTL() == 0 {
+		t.Fatalf("expected CNAME chain and answer, got %v %v", result.CnameChain, result.Answer)
+	}
+
+	result, err = Resolve(dns.Question{Name: "aw9e4taihaw8e7aw3aosawf.com", Qtype: dns.TypeTXT, Qclass: dns.ClassINET}, Options{})
+	if err != nil || result.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN for fake domain, got %v (%v)", result, err)
+	}
+
+	// Redirected domains are only rewritten for address queries
+	result, err = Resolve(dns.Question{Name: "lancache.steamcontent.com", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, Options{})
+	if err != nil || len(result.Answer) != 0 {
+		t.Fatalf("expected no AAAA records for redirected domain, got %v (%v)", result, err)
+	}
+}
+
+func TestCheckCnameChain(t *testing.T) {
+	cname := func(name, target string) *dns.CNAME {
+		return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME}, Target: target}
+	}
+
+	if err := checkCnameChain([]*dns.CNAME{cname("a.example.", "b.example."), cname("b.example.", "c.example.")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCnameChain([]*dns.CNAME{cname("a.example.", "A.example.")}); !errors.Is(err, ErrCnameLoop) {
+		t.Fatalf("expected loop, got %v", err)
+	}
+	if err := checkCnameChain([]*dns.CNAME{cname("a.example.", "b.example."), cname("b.example.", "a.example.")}); !errors.Is(err, ErrCnameLoop) {
+		t.Fatalf("expected loop, got %v", err)
+	}
+
+	var chain []*dns.CNAME
+	for i := 0; i <= maxCnameChain; i++ {
+		chain = append(chain, cname(fmt.Sprintf("%d.example.", i), fmt.Sprintf("%d.example.", i+1)))
+	}
+	if err := checkCnameChain(chain); !errors.Is(err, ErrCnameChainTooLong) {
+		t.Fatalf("expected chain too long, got %v", err)
+	}
+}
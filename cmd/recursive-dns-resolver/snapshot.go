@@ -0,0 +1,197 @@
+package recursive_dns_resolver
+
+import (
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"os"
+	"path"
+	file_util "resolver/cmd/file-util"
+	"time"
+)
+
+const defaultSnapshotInterval = 300
+
+// snapshotEntry is a cached result as written to the snapshot, records are in presentation format
+type snapshotEntry struct {
+	Name       string    `json:"name"`
+	Qtype      uint16    `json:"qtype"`
+	Qclass     uint16    `json:"qclass"`
+	Stored     time.Time `json:"stored"`
+	Expires    time.Time `json:"expires"`
+	Rcode      int       `json:"rcode"`
+	CnameChain []string  `json:"cname_chain,omitempty"`
+	Answer     []string  `json:"answer,omitempty"`
+	Ns         []string  `json:"ns,omitempty"`
+	Extra      []string  `json:"extra,omitempty"`
+	Signatures []string  `json:"signatures,omitempty"`
+	Secure     bool      `json:"secure,omitempty"`
+}
+
+// GetSnapshotPath returns the file the resolver cache is saved to.
+// It defaults to a file next to the cache-domains checkout and can be overridden using DNS_CACHE_SNAPSHOT.
+func GetSnapshotPath() string {
+	p, ok := os.LookupEnv("DNS_CACHE_SNAPSHOT")
+	if !ok {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			zap.S().Fatal(err)
+		}
+		p = path.Join(dir, "abs-resolver", "dns-cache.json")
+	}
+	err := os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	return p
+}
+
+// SaveCacheSnapshot writes all results of the resolver cache to GetSnapshotPath, ordered by recent use
+func SaveCacheSnapshot() error {
+	entries := getDomainCache().Entries()
+	snapshot := make([]snapshotEntry, 0, len(entries))
+	for _, entry := range entries {
+		snapshot = append(snapshot, snapshotEntry{
+			Name:       entry.key.name,
+			Qtype:      entry.key.qtype,
+			Qclass:     entry.key.qclass,
+			Stored:     entry.stored,
+			Expires:    entry.expires,
+			Rcode:      entry.result.Rcode,
+			CnameChain: cnamesToStrings(entry.result.CnameChain),
+			Answer:     recordsToStrings(entry.result.Answer),
+			Ns:         recordsToStrings(entry.result.Ns),
+			Extra:      recordsToStrings(entry.result.Extra),
+			Signatures: recordsToStrings(entry.result.Signatures),
+			Secure:     entry.result.Secure,
+		})
+	}
+	data, err := jsoniter.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	p := GetSnapshotPath()
+	err = file_util.WriteAtomic(p, data)
+	if err != nil {
+		return err
+	}
+	zap.S().Infof("Saved %d DNS cache entries to %s", len(snapshot), p)
+	return nil
+}
+
+// LoadCacheSnapshot fills the resolver cache from GetSnapshotPath.
+// The results keep the time they were stored, so their TTLs count down by the time that passed since.
+// A missing snapshot is not an error.
+func LoadCacheSnapshot() error {
+	p := GetSnapshotPath()
+	data, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot []snapshotEntry
+	err = jsoniter.Unmarshal(data, &snapshot)
+	if err != nil {
+		return fmt.Errorf("invalid DNS cache snapshot %s: %w", p, err)
+	}
+
+	c := getDomainCache()
+	now := time.Now()
+	loaded := 0
+	// Insert the least recently used first, so they are evicted first again
+	for i := len(snapshot) - 1; i >= 0; i-- {
+		entry := snapshot[i]
+		if now.After(entry.Expires.Add(c.maxStale)) {
+			continue
+		}
+		result, err := entry.result()
+		if err != nil {
+			zap.S().Warnf("Skipping DNS cache entry %s (%s)", entry.Name, err)
+			continue
+		}
+		key := cacheKey{name: entry.Name, qtype: entry.Qtype, qclass: entry.Qclass}
+		c.Set(key, result, entry.Stored, entry.Expires)
+		loaded++
+	}
+	zap.S().Infof("Loaded %d of %d DNS cache entries from %s", loaded, len(snapshot), p)
+	return nil
+}
+
+// RunCacheSnapshots saves the resolver cache every DNS_CACHE_SNAPSHOT_INTERVAL seconds, 0 disables it
+func RunCacheSnapshots() {
+	interval := loadTtl("DNS_CACHE_SNAPSHOT_INTERVAL", defaultSnapshotInterval)
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := SaveCacheSnapshot()
+		if err != nil {
+			zap.S().Errorf("Failed to save DNS cache snapshot (%s)", err)
+		}
+	}
+}
+
+func (e *snapshotEntry) result() (*Result, error) {
+	r := &Result{Rcode: e.Rcode, Secure: e.Secure}
+	for _, s := range e.CnameChain {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, err
+		}
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			return nil, fmt.Errorf("%s is no CNAME", s)
+		}
+		r.CnameChain = append(r.CnameChain, cname)
+	}
+	var err error
+	if r.Answer, err = stringsToRecords(e.Answer); err != nil {
+		return nil, err
+	}
+	if r.Ns, err = stringsToRecords(e.Ns); err != nil {
+		return nil, err
+	}
+	if r.Extra, err = stringsToRecords(e.Extra); err != nil {
+		return nil, err
+	}
+	if r.Signatures, err = stringsToRecords(e.Signatures); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func cnamesToStrings(cnames []*dns.CNAME) []string {
+	s := make([]string, 0, len(cnames))
+	for _, rr := range cnames {
+		s = append(s, rr.String())
+	}
+	return s
+}
+
+func recordsToStrings(records []dns.RR) []string {
+	s := make([]string, 0, len(records))
+	for _, rr := range records {
+		s = append(s, rr.String())
+	}
+	return s
+}
+
+func stringsToRecords(s []string) ([]dns.RR, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	records := make([]dns.RR, 0, len(s))
+	for _, line := range s {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rr)
+	}
+	return records, nil
+}
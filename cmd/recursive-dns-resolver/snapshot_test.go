@@ -0,0 +1,52 @@
+package recursive_dns_resolver
+
+import (
+	"github.com/miekg/dns"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	t.Setenv("DNS_CACHE_SNAPSHOT", path.Join(t.TempDir(), "dns-cache.json"))
+
+	q := dns.Question{Name: "snapshot.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	stored := time.Now().Add(-100 * time.Second)
+	getDomainCache().Set(questionKey(q), testResult(300), stored, stored.Add(300*time.Second))
+	unknown := dns.Question{Name: "unknown.example.", Qtype: 65280, Qclass: dns.ClassINET}
+	getDomainCache().Set(questionKey(unknown), &Result{Answer: []dns.RR{&dns.RFC3597{
+		Hdr:   dns.RR_Header{Name: "unknown.example.", Rrtype: 65280, Class: dns.ClassINET, Ttl: 300},
+		Rdata: "c0000201",
+	}}}, stored, stored.Add(300*time.Second))
+
+	err := SaveCacheSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	getDomainCache().Delete(questionKey(q))
+	getDomainCache().Delete(questionKey(unknown))
+
+	err = LoadCacheSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer getDomainCache().Delete(questionKey(q))
+	defer getDomainCache().Delete(questionKey(unknown))
+
+	r, found := cacheGet(q, Options{})
+	if !found {
+		t.Fatal("result not restored")
+	}
+	if len(r.CnameChain) != 1 || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("unexpected restored result %v", r)
+	}
+	// The TTL keeps counting down from the time the result was stored
+	if ttl := r.Answer[0].Header().Ttl; ttl > 200 || ttl < 190 {
+		t.Fatalf("expected remaining TTL of about 200, got %d", ttl)
+	}
+
+	r, found = cacheGet(unknown, Options{})
+	if !found || r.Answer[0].(*dns.RFC3597).Rdata != "c0000201" {
+		t.Fatalf("unknown record type not restored: %v", r)
+	}
+}
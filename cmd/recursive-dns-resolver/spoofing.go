@@ -0,0 +1,164 @@
+package recursive_dns_resolver
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// sourcePortSamples is the number of ports the operating system is asked for to check their randomness
+	sourcePortSamples = 16
+	// minPortRange is the number of source ports below which spoofed answers get too easy to guess
+	minPortRange = 16384
+)
+
+var (
+	ErrOutOfBailiwick   = errors.New("out of bailiwick")
+	ErrQuestionMismatch = errors.New("answer is for another question")
+)
+
+var (
+	caseRandomisationOnce sync.Once
+	caseRandomisation     bool
+	sourcePortsOnce       sync.Once
+)
+
+// useCaseRandomisation reports whether DNS_0X20 enables mixing the case of query names,
+// which answers have to echo. Servers not preserving the case then fail.
+func useCaseRandomisation() bool {
+	caseRandomisationOnce.Do(func() {
+		if v, ok := os.LookupEnv("DNS_0X20"); ok {
+			switch strings.ToLower(v) {
+			case "on", "true", "1":
+				caseRandomisation = true
+			case "off", "false", "0":
+			default:
+				zap.S().Warnf("Invalid DNS_0X20 %q", v)
+			}
+		}
+	})
+	return caseRandomisation
+}
+
+// randomiseCase returns name with the case of every letter chosen at random, as in draft-vixie-dnsext-dns0x20
+func randomiseCase(name string) string {
+	b := []byte(name)
+	random := make([]byte, len(b))
+	if _, err := crand.Read(random); err != nil {
+		zap.S().Fatal(err)
+	}
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c >= 'a' && c <= 'z' && random[i]&1 == 1 {
+			c -= 'a' - 'A'
+		}
+		b[i] = c
+	}
+	return string(b)
+}
+
+// queryId returns a message ID from a cryptographically secure source, unlike dns.Id it cannot be replaced
+func queryId() uint16 {
+	var b [2]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		zap.S().Fatal(err)
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// checkResponse verifies in answers the question sent, the name in the exact case when it was randomised
+func checkResponse(sent dns.Question, in *dns.Msg, exactCase bool) error {
+	if len(in.Question) != 1 {
+		return fmt.Errorf("%w: %d questions", ErrQuestionMismatch, len(in.Question))
+	}
+	q := in.Question[0]
+	if q.Qtype != sent.Qtype || q.Qclass != sent.Qclass || !strings.EqualFold(q.Name, sent.Name) {
+		return fmt.Errorf("%w: %s %s instead of %s %s", ErrQuestionMismatch, q.Name, dns.TypeToString[q.Qtype], sent.Name, dns.TypeToString[sent.Qtype])
+	}
+	if exactCase && q.Name != sent.Name {
+		return fmt.Errorf("%w: case of %s not echoed as %s", ErrQuestionMismatch, q.Name, sent.Name)
+	}
+	return nil
+}
+
+// restoreCase gives the records owned by the randomised name the name as asked, so answers look as usual
+func restoreCase(in *dns.Msg, name string) {
+	for _, section := range [][]dns.RR{in.Answer, in.Ns, in.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, name) {
+				rr.Header().Name = name
+			}
+		}
+	}
+	in.Question[0].Name = name
+}
+
+// inBailiwick reports whether the servers of zone may give records of name
+func inBailiwick(zone string, name string) bool {
+	return dns.IsSubDomain(zone, name)
+}
+
+// checkSourcePorts warns when the source ports of upstream queries are predictable.
+// Every query uses a new socket, its port is chosen by the operating system.
+func checkSourcePorts() {
+	ports := make([]int, 0, sourcePortSamples)
+	for i := 0; i < sourcePortSamples; i++ {
+		conn, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			zap.S().Warnf("Failed to check source port randomness (%s)", err)
+			return
+		}
+		ports = append(ports, conn.LocalAddr().(*net.UDPAddr).Port)
+		_ = conn.Close()
+	}
+	if predictablePorts(ports) {
+		zap.S().Warnf("Source ports of upstream queries look predictable (%v), spoofed answers are easier to guess", ports)
+	}
+
+	if lo, hi, ok := localPortRange(); ok && hi-lo+1 < minPortRange {
+		zap.S().Warnf("Only %d source ports are used for upstream queries, see net.ipv4.ip_local_port_range", hi-lo+1)
+	}
+}
+
+// predictablePorts reports whether ports often repeat or mostly follow each other closely
+func predictablePorts(ports []int) bool {
+	seen := make(map[int]bool)
+	repeated := 0
+	near := 0
+	for i, port := range ports {
+		if seen[port] {
+			repeated++
+		}
+		seen[port] = true
+		if i > 0 {
+			d := port - ports[i-1]
+			if d >= -16 && d <= 16 {
+				near++
+			}
+		}
+	}
+	return repeated > len(ports)/4 || near > len(ports)/2
+}
+
+// localPortRange returns the ephemeral port range of Linux
+func localPortRange() (int, int, bool) {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if err != nil {
+		return 0, 0, false
+	}
+	var lo, hi int
+	if _, err = fmt.Sscan(string(data), &lo, &hi); err != nil {
+		return 0, 0, false
+	}
+	return lo, hi, true
+}
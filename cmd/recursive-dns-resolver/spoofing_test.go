@@ -0,0 +1,164 @@
+package recursive_dns_resolver
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRandomiseCase(t *testing.T) {
+	name := "www.lancache-example.test."
+	changed := false
+	for i := 0; i < 10; i++ {
+		mixed := randomiseCase(name)
+		if !strings.EqualFold(mixed, name) {
+			t.Fatalf("%s is not %s", mixed, name)
+		}
+		if mixed != name {
+			changed = true
+		}
+	}
+	if !changed {
+		t.Fatal("case never randomised")
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	sent := dns.Question{Name: "wWw.ExAmple.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	in := new(dns.Msg)
+	in.SetQuestion("wWw.ExAmple.test.", dns.TypeA)
+	if err := checkResponse(sent, in, true); err != nil {
+		t.Fatal(err)
+	}
+
+	in.SetQuestion("www.example.test.", dns.TypeA)
+	if err := checkResponse(sent, in, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkResponse(sent, in, true); !errors.Is(err, ErrQuestionMismatch) {
+		t.Fatal("case not checked")
+	}
+
+	in.SetQuestion("www.example.test.", dns.TypeAAAA)
+	if err := checkResponse(sent, in, false); !errors.Is(err, ErrQuestionMismatch) {
+		t.Fatal("type not checked")
+	}
+	in.SetQuestion("evil.test.", dns.TypeA)
+	if err := checkResponse(sent, in, false); !errors.Is(err, ErrQuestionMismatch) {
+		t.Fatal("name not checked")
+	}
+	in.Question = nil
+	if err := checkResponse(sent, in, false); !errors.Is(err, ErrQuestionMismatch) {
+		t.Fatal("missing question accepted")
+	}
+}
+
+func TestPredictablePorts(t *testing.T) {
+	if !predictablePorts([]int{40000, 40001, 40002, 40003, 40004, 40005, 40006, 40007}) {
+		t.Fatal("sequential ports not detected")
+	}
+	if !predictablePorts([]int{53, 53, 53, 53, 53, 53, 53, 53}) {
+		t.Fatal("fixed port not detected")
+	}
+	if predictablePorts([]int{51234, 33012, 60813, 41290, 37755, 58001, 45123, 32790}) {
+		t.Fatal("random ports reported as predictable")
+	}
+}
+
+func referral(zone string, ns string, glue ...dns.RR) *dns.Msg {
+	in := new(dns.Msg)
+	in.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: ns}}
+	in.Extra = glue
+	return in
+}
+
+func glue(name string, ip net.IP) dns.RR {
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: ip}
+}
+
+func TestDelegationBailiwick(t *testing.T) {
+	res := newResolution()
+
+	// Glue for other names than the nameservers, or out of the zone asked, is ignored
+	in := referral("example.test.", "ns.example.test.",
+		glue("ns.example.test.", net.IPv4(192, 0, 2, 1)),
+		glue("www.example.test.", net.IPv4(192, 0, 2, 2)),
+		glue("ns.example.test.", net.IPv4(192, 0, 2, 3)))
+	in.Ns = append(in.Ns, &dns.NS{Hdr: dns.RR_Header{Name: "example.test.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns.victim.example."})
+	in.Extra = append(in.Extra, glue("ns.victim.example.", net.IPv4(203, 0, 113, 66)))
+	subZone, servers, err := delegation(in, "test.", "www.example.test.", res)
+	if err != nil || subZone != "example.test." || len(servers) != 2 || servers[0] != "192.0.2.1" || servers[1] != "192.0.2.3" {
+		t.Fatalf("unexpected delegation to %s %v (%v)", subZone, servers, err)
+	}
+
+	// Servers can only delegate below their zone, to an ancestor of the name
+	for _, test := range []struct{ zone, subZone, name string }{
+		{"example.test.", "test.", "www.example.test."},
+		{"example.test.", "example.test.", "www.example.test."},
+		{"test.", "other.", "www.example.test."},
+		{"test.", "other.test.", "www.example.test."},
+	} {
+		in = referral(test.subZone, "ns."+test.subZone, glue("ns."+test.subZone, net.IPv4(192, 0, 2, 1)))
+		if _, _, err = delegation(in, test.zone, test.name, res); !errors.Is(err, ErrOutOfBailiwick) {
+			t.Fatalf("referral from %s to %s for %s accepted", test.zone, test.subZone, test.name)
+		}
+	}
+}
+
+func TestAnswerBailiwick(t *testing.T) {
+	setMinimisation(t, minimisationOff)
+	resetServerStats()
+	defer resetServerStats()
+
+	// The servers of test. answer an alias to a name they are no authority for, with a record for it
+	startFakeZone(t, "127.0.0.3", func(q dns.Question, r *dns.Msg) {
+		r.Authoritative = true
+		r.Answer = append(r.Answer,
+			&dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "victim.example."},
+			&dns.A{Hdr: dns.RR_Header{Name: "victim.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(203, 0, 113, 66)})
+		r.Extra = append(r.Extra, &dns.A{Hdr: dns.RR_Header{Name: "ns.victim.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(203, 0, 113, 66)})
+	})
+
+	target := dns.Question{Name: "victim.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	cacheSet(target, &Result{Rcode: dns.RcodeSuccess, Answer: []dns.RR{glue("victim.example.", net.IPv4(192, 0, 2, 10))}})
+	defer getDomainCache().Delete(questionKey(target))
+
+	q := dns.Question{Name: "www.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	result, err := resolveRecursive([]string{"127.0.0.3"}, "test.", q, Options{SkipRedirect: true, skipValidation: true}, nil, newResolution())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.CnameChain) != 1 || len(result.Answer) != 1 || !result.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, 10)) {
+		t.Fatalf("out of bailiwick record accepted: %v", result.Answer)
+	}
+}
+
+func TestCaseRandomisation(t *testing.T) {
+	caseRandomisationOnce.Do(func() {})
+	caseRandomisation = true
+	defer func() {
+		caseRandomisation = false
+	}()
+	setMinimisation(t, minimisationOff)
+	resetServerStats()
+	defer resetServerStats()
+	startFakeHierarchy(t, false)
+
+	// Answers have the name as asked
+	q := dns.Question{Name: "www.sub.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	result, err := resolveRecursive([]string{"127.0.0.2"}, ".", q, Options{skipValidation: true}, nil, newResolution())
+	if err != nil || len(result.Answer) != 1 || result.Answer[0].Header().Name != "www.sub.test." {
+		t.Fatalf("expected answer, got %v (%v)", result, err)
+	}
+
+	// A server not echoing the case is not trusted
+	startFakeZone(t, "127.0.0.4", func(q dns.Question, r *dns.Msg) {
+		r.Question[0].Name = strings.ToLower(q.Name)
+		r.Answer = append(r.Answer, glue(r.Question[0].Name, net.IPv4(203, 0, 113, 66)))
+	})
+	if _, err = queryServers([]string{"127.0.0.4"}, q, newResolution()); !errors.Is(err, ErrQuestionMismatch) {
+		t.Fatalf("expected mismatch, got %v", err)
+	}
+}
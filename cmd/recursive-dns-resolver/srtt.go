@@ -0,0 +1,155 @@
+package recursive_dns_resolver
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// srttWeight is the weight of previous RTTs in the smoothed RTT, as in BIND
+	srttWeight = 7
+	// maxSrtt caps the penalty of failures, so a server can recover
+	maxSrtt = 5 * time.Second
+	// failurePenalty is the RTT accounted for a failed query to a server without samples
+	failurePenalty = time.Second
+	// minBackoff and maxBackoff bound the time a failing server is avoided, doubling per failure
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+	// probePercent is the chance of trying another than the fastest server, so its RTT stays current
+	probePercent = 5
+	// maxTrackedServers bounds the statistics, servers not used for staleStats are dropped beyond it
+	maxTrackedServers = 10000
+	staleStats        = 30 * time.Minute
+)
+
+// NameserverStats are the statistics kept for a nameserver
+type NameserverStats struct {
+	Address string
+	// SRTT is the smoothed round trip time, failures count as slow answers
+	SRTT time.Duration
+	// Queries and Failures count all queries and failed queries
+	Queries  int
+	Failures int
+	// ConsecutiveFailures is the number of failures since the last answer
+	ConsecutiveFailures int
+	// BackoffUntil is when the server is preferred again after failures
+	BackoffUntil time.Time
+	LastUsed     time.Time
+}
+
+var (
+	serverStatsMu sync.Mutex
+	serverStats   = make(map[string]*NameserverStats)
+)
+
+// GetNameserverStats returns the statistics of all nameservers queried recently, fastest first
+func GetNameserverStats() []NameserverStats {
+	serverStatsMu.Lock()
+	stats := make([]NameserverStats, 0, len(serverStats))
+	for _, s := range serverStats {
+		stats = append(stats, *s)
+	}
+	serverStatsMu.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].SRTT < stats[j].SRTT
+	})
+	return stats
+}
+
+// statsFor has to be called with serverStatsMu held
+func statsFor(server string, now time.Time) *NameserverStats {
+	s, ok := serverStats[server]
+	if !ok {
+		if len(serverStats) >= maxTrackedServers {
+			for address, old := range serverStats {
+				if now.Sub(old.LastUsed) > staleStats {
+					delete(serverStats, address)
+				}
+			}
+		}
+		s = &NameserverStats{Address: server}
+		serverStats[server] = s
+	}
+	s.LastUsed = now
+	s.Queries++
+	return s
+}
+
+// recordSuccess accounts an answer of server after rtt
+func recordSuccess(server string, rtt time.Duration) {
+	serverStatsMu.Lock()
+	defer serverStatsMu.Unlock()
+	s := statsFor(server, time.Now())
+	if s.Queries == 1 {
+		s.SRTT = rtt
+	} else {
+		s.SRTT = (s.SRTT*srttWeight + rtt) / (srttWeight + 1)
+	}
+	s.ConsecutiveFailures = 0
+	s.BackoffUntil = time.Time{}
+}
+
+// recordFailure accounts a timeout or error of server, doubling its SRTT and backing off exponentially
+func recordFailure(server string) {
+	serverStatsMu.Lock()
+	defer serverStatsMu.Unlock()
+	now := time.Now()
+	s := statsFor(server, now)
+	s.Failures++
+	s.ConsecutiveFailures++
+	if s.SRTT == 0 {
+		s.SRTT = failurePenalty
+	} else {
+		s.SRTT *= 2
+	}
+	if s.SRTT > maxSrtt {
+		s.SRTT = maxSrtt
+	}
+	backoff := minBackoff
+	for i := 1; i < s.ConsecutiveFailures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	s.BackoffUntil = now.Add(backoff)
+}
+
+// orderServers returns the servers in the order they should be tried:
+// healthy before backed off servers, then by SRTT, with servers without samples first so they get measured.
+// Occasionally another server is moved to the front, so the SRTT of slower servers stays current.
+func orderServers(servers []string) []string {
+	ordered := shuffled(servers)
+	now := time.Now()
+
+	serverStatsMu.Lock()
+	backedOff := make(map[string]bool, len(ordered))
+	srtt := make(map[string]time.Duration, len(ordered))
+	for _, server := range ordered {
+		if s, ok := serverStats[server]; ok {
+			srtt[server] = s.SRTT
+			backedOff[server] = now.Before(s.BackoffUntil)
+		}
+	}
+	serverStatsMu.Unlock()
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if backedOff[ordered[i]] != backedOff[ordered[j]] {
+			return !backedOff[ordered[i]]
+		}
+		return srtt[ordered[i]] < srtt[ordered[j]]
+	})
+
+	rngMu.Lock()
+	probe := len(ordered) > 1 && rng.Intn(100) < probePercent
+	var i int
+	if probe {
+		i = 1 + rng.Intn(len(ordered)-1)
+	}
+	rngMu.Unlock()
+	if probe && !backedOff[ordered[i]] {
+		ordered[0], ordered[i] = ordered[i], ordered[0]
+	}
+	return ordered
+}
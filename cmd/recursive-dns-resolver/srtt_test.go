@@ -0,0 +1,73 @@
+package recursive_dns_resolver
+
+import (
+	"testing"
+	"time"
+)
+
+func resetServerStats() {
+	serverStatsMu.Lock()
+	serverStats = make(map[string]*NameserverStats)
+	serverStatsMu.Unlock()
+}
+
+func TestSmoothedRtt(t *testing.T) {
+	resetServerStats()
+	defer resetServerStats()
+
+	recordSuccess("192.0.2.1", 80*time.Millisecond)
+	recordSuccess("192.0.2.1", 160*time.Millisecond)
+	stats := GetNameserverStats()
+	if len(stats) != 1 || stats[0].SRTT != 90*time.Millisecond || stats[0].Queries != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	recordFailure("192.0.2.1")
+	recordFailure("192.0.2.1")
+	stats = GetNameserverStats()
+	if stats[0].SRTT != 360*time.Millisecond || stats[0].ConsecutiveFailures != 2 || stats[0].Failures != 2 {
+		t.Fatalf("failures not accounted %+v", stats[0])
+	}
+	if backoff := time.Until(stats[0].BackoffUntil); backoff < minBackoff || backoff > 2*minBackoff {
+		t.Fatalf("expected backoff of %s, got %s", 2*minBackoff, backoff)
+	}
+
+	recordSuccess("192.0.2.1", 40*time.Millisecond)
+	stats = GetNameserverStats()
+	if stats[0].ConsecutiveFailures != 0 || !stats[0].BackoffUntil.IsZero() {
+		t.Fatalf("answer did not end backoff %+v", stats[0])
+	}
+}
+
+func TestOrderServers(t *testing.T) {
+	resetServerStats()
+	defer resetServerStats()
+
+	recordSuccess("192.0.2.1", 200*time.Millisecond)
+	recordSuccess("192.0.2.2", 5*time.Millisecond)
+	recordSuccess("192.0.2.3", 50*time.Millisecond)
+	recordFailure("192.0.2.4")
+	servers := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5"}
+
+	first := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		ordered := orderServers(servers)
+		first[ordered[0]]++
+		if ordered[len(ordered)-1] != "192.0.2.4" {
+			t.Fatalf("backed off server not last: %v", ordered)
+		}
+	}
+	// Servers without samples are measured first
+	if first["192.0.2.5"] < 900 {
+		t.Fatalf("unmeasured server not preferred: %v", first)
+	}
+
+	recordSuccess("192.0.2.5", 500*time.Millisecond)
+	first = make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		first[orderServers(servers)[0]]++
+	}
+	if first["192.0.2.2"] < 900 || first["192.0.2.2"] == 1000 {
+		t.Fatalf("expected the fastest server with occasional probes, got %v", first)
+	}
+}
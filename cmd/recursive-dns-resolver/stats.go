@@ -0,0 +1,41 @@
+package recursive_dns_resolver
+
+import (
+	"go.uber.org/zap"
+	"time"
+)
+
+const defaultStatsInterval = 300
+
+// RunStatsLog logs the resolver statistics at debug level every DNS_STATS_INTERVAL seconds, 0 disables it
+func RunStatsLog() {
+	interval := loadTtl("DNS_STATS_INTERVAL", defaultStatsInterval)
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	since := time.Now()
+	for now := range ticker.C {
+		logNameserverStats(since)
+		logMinimisationStats()
+		since = now
+	}
+}
+
+// logNameserverStats logs the nameservers used since the last time, fastest first
+func logNameserverStats(since time.Time) {
+	for _, s := range GetNameserverStats() {
+		if s.LastUsed.Before(since) {
+			continue
+		}
+		zap.S().Debugf("Nameserver %s: srtt %s, %d queries, %d failed", s.Address, s.SRTT, s.Queries, s.Failures)
+	}
+}
+
+// logMinimisationStats logs the QNAME minimisation counters since the start
+func logMinimisationStats() {
+	s := GetMinimisationStats()
+	zap.S().Debugf("QNAME minimisation: %d minimised queries, %d fallbacks to full queries, %d of them after NXDOMAIN",
+		s.Queries, s.Fallbacks, s.NxdomainFallbacks)
+}
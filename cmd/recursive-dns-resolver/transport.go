@@ -0,0 +1,82 @@
+package recursive_dns_resolver
+
+import (
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// transport are the address families nameservers are queried over, independent of the asked type
+type transport struct {
+	ipv4 bool
+	ipv6 bool
+}
+
+var (
+	transportOnce sync.Once
+	hostTransport transport
+)
+
+// getTransport returns the configured transport, DNS_TRANSPORT is ipv4, ipv6, dual or auto.
+// With auto, the default, every family the host has a route to a root server for is used.
+func getTransport() transport {
+	transportOnce.Do(func() {
+		mode, ok := os.LookupEnv("DNS_TRANSPORT")
+		if !ok {
+			mode = "auto"
+		}
+		switch strings.ToLower(mode) {
+		case "ipv4":
+			hostTransport = transport{ipv4: true}
+		case "ipv6":
+			hostTransport = transport{ipv6: true}
+		case "dual":
+			hostTransport = transport{ipv4: true, ipv6: true}
+		default:
+			if !strings.EqualFold(mode, "auto") {
+				zap.S().Warnf("Invalid DNS_TRANSPORT %q", mode)
+			}
+			// a.root-servers.net, dialing UDP only checks for a route and sends nothing
+			hostTransport = transport{
+				ipv4: hasRoute("udp4", "198.41.0.4:53"),
+				ipv6: hasRoute("udp6", "[2001:503:ba3e::2:30]:53"),
+			}
+			if !hostTransport.ipv4 && !hostTransport.ipv6 {
+				hostTransport.ipv4 = true
+			}
+		}
+		zap.S().Infof("Querying nameservers over IPv4: %t, IPv6: %t", hostTransport.ipv4, hostTransport.ipv6)
+	})
+	return hostTransport
+}
+
+func hasRoute(network string, address string) bool {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// allows reports whether the nameserver at ip can be queried
+func (t transport) allows(ip net.IP) bool {
+	if ip.To4() != nil {
+		return t.ipv4
+	}
+	return t.ipv6 && ip.To16() != nil
+}
+
+// filter returns the addresses of servers that can be queried
+func (t transport) filter(servers []string) []string {
+	filtered := make([]string, 0, len(servers))
+	for _, s := range servers {
+		ip := net.ParseIP(s)
+		if ip != nil && t.allows(ip) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
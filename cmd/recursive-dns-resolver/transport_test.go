@@ -0,0 +1,25 @@
+package recursive_dns_resolver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTransportFilter(t *testing.T) {
+	servers := []string{"198.41.0.4", "2001:503:ba3e::2:30", "invalid"}
+
+	tests := []struct {
+		transport transport
+		expected  []string
+	}{
+		{transport{ipv4: true}, []string{"198.41.0.4"}},
+		{transport{ipv6: true}, []string{"2001:503:ba3e::2:30"}},
+		{transport{ipv4: true, ipv6: true}, []string{"198.41.0.4", "2001:503:ba3e::2:30"}},
+	}
+	for _, test := range tests {
+		filtered := test.transport.filter(servers)
+		if !reflect.DeepEqual(filtered, test.expected) {
+			t.Fatalf("%+v: expected %v, got %v", test.transport, test.expected, filtered)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package sni_proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	extensionServerName      = 0x0000
+	serverNameTypeHostName   = 0x00
+
+	// maxClientHelloLength bounds the memory used for a single connection before it is forwarded
+	maxClientHelloLength = 64 * 1024
+)
+
+var errNoServerName = errors.New("client hello without server name")
+
+// readClientHello reads the TLS records holding the ClientHello from r.
+// It returns all bytes read, so they can be replayed to the upstream server, and the requested server name.
+func readClientHello(r io.Reader) (raw []byte, serverName string, err error) {
+	var handshake []byte
+	for {
+		header := make([]byte, 5)
+		_, err = io.ReadFull(r, header)
+		if err != nil {
+			return raw, "", err
+		}
+		raw = append(raw, header...)
+		if header[0] != recordTypeHandshake {
+			return raw, "", fmt.Errorf("unexpected TLS record type %d", header[0])
+		}
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if len(raw)+length > maxClientHelloLength {
+			return raw, "", fmt.Errorf("client hello too large")
+		}
+		fragment := make([]byte, length)
+		_, err = io.ReadFull(r, fragment)
+		if err != nil {
+			return raw, "", err
+		}
+		raw = append(raw, fragment...)
+		handshake = append(handshake, fragment...)
+
+		// A ClientHello may be split across several records
+		if len(handshake) >= 4 {
+			messageLength := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if len(handshake) >= 4+messageLength {
+				serverName, err = parseClientHello(handshake[:4+messageLength])
+				return raw, serverName, err
+			}
+		}
+	}
+}
+
+// parseClientHello extracts the server_name extension of a ClientHello handshake message
+func parseClientHello(message []byte) (string, error) {
+	p := parser{b: message}
+	if p.u8() != handshakeTypeClientHello {
+		return "", fmt.Errorf("not a client hello")
+	}
+	p.skip(3)  // length
+	p.skip(2)  // client version
+	p.skip(32) // random
+	p.skip(int(p.u8()))
+	p.skip(int(p.u16()))
+	p.skip(int(p.u8()))
+	if p.err != nil {
+		return "", p.err
+	}
+	if len(p.b) == 0 {
+		return "", errNoServerName
+	}
+
+	extensions := parser{b: p.bytes(int(p.u16()))}
+	for len(extensions.b) > 0 && extensions.err == nil {
+		extensionType := extensions.u16()
+		data := parser{b: extensions.bytes(int(extensions.u16()))}
+		if extensionType != extensionServerName {
+			continue
+		}
+		names := parser{b: data.bytes(int(data.u16()))}
+		for len(names.b) > 0 && names.err == nil {
+			nameType := names.u8()
+			name := names.bytes(int(names.u16()))
+			if nameType == serverNameTypeHostName && names.err == nil {
+				return string(name), nil
+			}
+		}
+	}
+	if p.err != nil {
+		return "", p.err
+	}
+	if extensions.err != nil {
+		return "", extensions.err
+	}
+	return "", errNoServerName
+}
+
+// parser reads big endian values, remembering the first out of bounds access
+type parser struct {
+	b   []byte
+	err error
+}
+
+func (p *parser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if n > len(p.b) {
+		p.err = fmt.Errorf("truncated client hello")
+		return nil
+	}
+	b := p.b[:n]
+	p.b = p.b[n:]
+	return b
+}
+
+func (p *parser) skip(n int) {
+	p.bytes(n)
+}
+
+func (p *parser) u8() uint8 {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (p *parser) u16() uint16 {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
@@ -0,0 +1,77 @@
+package sni_proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// captureClientHello returns the bytes a TLS client sends first when connecting to serverName
+func captureClientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		_ = conn.Handshake()
+	}()
+	defer server.Close()
+
+	var captured bytes.Buffer
+	buf := make([]byte, 16*1024)
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, err := server.Read(buf)
+		captured.Write(buf[:n])
+		if err != nil || n < len(buf) {
+			break
+		}
+	}
+	_ = client.Close()
+	return captured.Bytes()
+}
+
+func TestReadClientHello(t *testing.T) {
+	hello := captureClientHello(t, "lancache.steamcontent.com")
+	raw, serverName, err := readClientHello(bytes.NewReader(hello))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "lancache.steamcontent.com" {
+		t.Fatalf("unexpected server name %q", serverName)
+	}
+	if !bytes.Equal(raw, hello) {
+		t.Fatal("raw bytes do not match the client hello")
+	}
+}
+
+func TestReadClientHelloFragmented(t *testing.T) {
+	hello := captureClientHello(t, "origin-a.akamaihd.net")
+	// Split the handshake message into two records
+	body := hello[5:]
+	half := len(body) / 2
+	var fragmented []byte
+	fragmented = append(fragmented, 0x16, hello[1], hello[2], byte(half>>8), byte(half))
+	fragmented = append(fragmented, body[:half]...)
+	fragmented = append(fragmented, 0x16, hello[1], hello[2], byte((len(body)-half)>>8), byte(len(body)-half))
+	fragmented = append(fragmented, body[half:]...)
+
+	_, serverName, err := readClientHello(bytes.NewReader(fragmented))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "origin-a.akamaihd.net" {
+		t.Fatalf("unexpected server name %q", serverName)
+	}
+}
+
+func TestReadClientHelloWithoutServerName(t *testing.T) {
+	hello := captureClientHello(t, "")
+	if _, _, err := readClientHello(bytes.NewReader(hello)); err != errNoServerName {
+		t.Fatalf("expected %v, got %v", errNoServerName, err)
+	}
+	if _, _, err := readClientHello(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n"))); err == nil {
+		t.Fatal("expected error for plain HTTP")
+	}
+}
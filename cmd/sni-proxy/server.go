@@ -0,0 +1,113 @@
+package sni_proxy
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	lan_cache "resolver/cmd/lan-cache"
+	recursive_dns_resolver "resolver/cmd/recursive-dns-resolver"
+	"time"
+)
+
+const (
+	clientHelloTimeout = 10 * time.Second
+	dialTimeout        = 10 * time.Second
+)
+
+// Start tunnels TLS connections for redirected domains to their real upstream, selected by the SNI of the ClientHello.
+// The connections are not terminated, so HTTPS keeps working for services with mixed content.
+func Start() {
+	listener, err := net.Listen("tcp", ":443")
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	defer listener.Close()
+
+	for {
+		var conn net.Conn
+		conn, err = listener.Accept()
+		if err != nil {
+			zap.S().Errorf("Failed to accept TLS connection (%s)", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go handleConn(conn)
+	}
+}
+
+func handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	hello, serverName, err := readClientHello(conn)
+	if err != nil {
+		zap.S().Debugf("Failed to read client hello from %s (%s)", conn.RemoteAddr(), err)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	// Only redirected domains are tunneled, so we are not an open relay for arbitrary hosts
+	if _, found := lan_cache.GetServiceForDomain(serverName); !found {
+		zap.S().Warnf("Refusing TLS connection from %s to %s, not a redirected domain", conn.RemoteAddr(), serverName)
+		return
+	}
+
+	upstream, err := dialUpstream(serverName)
+	if err != nil {
+		zap.S().Errorf("Failed to connect to %s (%s)", serverName, err)
+		return
+	}
+	defer upstream.Close()
+	zap.S().Debugf("Tunneling TLS connection from %s to %s (%s)", conn.RemoteAddr(), serverName, upstream.RemoteAddr())
+
+	_, err = upstream.Write(hello)
+	if err != nil {
+		zap.S().Errorf("Failed to forward client hello to %s (%s)", serverName, err)
+		return
+	}
+	pipe(conn, upstream)
+}
+
+func dialUpstream(serverName string) (net.Conn, error) {
+	ips, err := recursive_dns_resolver.ResolveDomain(serverName, false, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no upstream address for %s", serverName)
+	}
+	for _, ip := range ips {
+		if net.ParseIP(ip).Equal(recursive_dns_resolver.GetOutboundIP()) {
+			err = fmt.Errorf("refusing to tunnel to ourselves (%s)", ip)
+			continue
+		}
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(ip, "443"), dialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// pipe copies data in both directions until both sides are done
+func pipe(client net.Conn, upstream net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(upstream, client)
+		closeWrite(upstream)
+		close(done)
+	}()
+	_, _ = io.Copy(client, upstream)
+	closeWrite(client)
+	<-done
+}
+
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+	} else {
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,106 @@
+package trust_anchor
+
+import (
+	_ "embed"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+// embeddedRootAnchors is the IANA root-anchors.xml the resolver starts with when it has no state yet
+//
+//go:embed root-anchors.xml
+var embeddedRootAnchors []byte
+
+var ErrInvalidAnchors = errors.New("invalid trust anchors")
+
+// xmlTrustAnchor is the root-anchors.xml format of RFC 7958
+type xmlTrustAnchor struct {
+	XMLName    xml.Name       `xml:"TrustAnchor"`
+	Zone       string         `xml:"Zone"`
+	KeyDigests []xmlKeyDigest `xml:"KeyDigest"`
+}
+
+type xmlKeyDigest struct {
+	ValidFrom  string `xml:"validFrom,attr"`
+	ValidUntil string `xml:"validUntil,attr"`
+	KeyTag     uint16 `xml:"KeyTag"`
+	Algorithm  uint8  `xml:"Algorithm"`
+	DigestType uint8  `xml:"DigestType"`
+	Digest     string `xml:"Digest"`
+}
+
+// digestLengths are the hex lengths of the digest types a DS can have
+var digestLengths = map[uint8]int{
+	dns.SHA1:   40,
+	dns.SHA256: 64,
+	dns.SHA384: 96,
+}
+
+// parseRootAnchors returns the DS records of a root-anchors.xml that are valid at now
+func parseRootAnchors(data []byte, now time.Time) ([]*dns.DS, error) {
+	var anchor xmlTrustAnchor
+	err := xml.Unmarshal(data, &anchor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAnchors, err)
+	}
+	if strings.TrimSpace(anchor.Zone) != "." {
+		return nil, fmt.Errorf("%w: anchors are for zone %q instead of the root", ErrInvalidAnchors, anchor.Zone)
+	}
+
+	var anchors []*dns.DS
+	for _, kd := range anchor.KeyDigests {
+		if kd.ValidFrom != "" {
+			from, err := time.Parse(time.RFC3339, kd.ValidFrom)
+			if err != nil {
+				return nil, fmt.Errorf("%w: validFrom of key %d (%s)", ErrInvalidAnchors, kd.KeyTag, err)
+			}
+			if now.Before(from) {
+				continue
+			}
+		}
+		if kd.ValidUntil != "" {
+			until, err := time.Parse(time.RFC3339, kd.ValidUntil)
+			if err != nil {
+				return nil, fmt.Errorf("%w: validUntil of key %d (%s)", ErrInvalidAnchors, kd.KeyTag, err)
+			}
+			if !now.Before(until) {
+				continue
+			}
+		}
+
+		digest := strings.ToUpper(strings.TrimSpace(kd.Digest))
+		if _, err := hex.DecodeString(digest); err != nil || len(digest) != digestLengths[kd.DigestType] {
+			return nil, fmt.Errorf("%w: digest of key %d", ErrInvalidAnchors, kd.KeyTag)
+		}
+		anchors = append(anchors, &dns.DS{
+			Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+			KeyTag:     kd.KeyTag,
+			Algorithm:  kd.Algorithm,
+			DigestType: kd.DigestType,
+			Digest:     digest,
+		})
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("%w: no currently valid key digest", ErrInvalidAnchors)
+	}
+	return anchors, nil
+}
+
+// matchesDigest reports whether one of anchors is the digest of key
+func matchesDigest(key *dns.DNSKEY, anchors []*dns.DS) bool {
+	for _, ds := range anchors {
+		if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+			continue
+		}
+		keyDs := key.ToDS(ds.DigestType)
+		if keyDs != nil && strings.EqualFold(keyDs.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
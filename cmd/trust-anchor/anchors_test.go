@@ -0,0 +1,66 @@
+package trust_anchor
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedRootAnchors(t *testing.T) {
+	anchors, err := parseRootAnchors(embeddedRootAnchors, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := map[uint16]bool{}
+	for _, ds := range anchors {
+		tags[ds.KeyTag] = true
+	}
+	if !tags[20326] || !tags[38696] {
+		t.Fatalf("expected KSK-2017 and KSK-2024, got %v", anchors)
+	}
+}
+
+func TestParseRootAnchors(t *testing.T) {
+	data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<TrustAnchor id="test" source="http://data.iana.org/root-anchors/root-anchors.xml">
+<Zone>.</Zone>
+<KeyDigest id="old" validFrom="2010-07-15T00:00:00+00:00" validUntil="2019-01-11T00:00:00+00:00">
+<KeyTag>19036</KeyTag>
+<Algorithm>8</Algorithm>
+<DigestType>2</DigestType>
+<Digest>49AAC11D7B6F6446702E54A1607371607A1A41855200FD2CE1CDDE32F24E8FB5</Digest>
+</KeyDigest>
+<KeyDigest id="current" validFrom="2017-02-02T00:00:00+00:00">
+<KeyTag>20326</KeyTag>
+<Algorithm>8</Algorithm>
+<DigestType>2</DigestType>
+<Digest>e06d44b80b8f1d39a95c0b0d7c65d08458e880409bbc683457104237c7f8ec8d</Digest>
+</KeyDigest>
+</TrustAnchor>`)
+
+	anchors, err := parseRootAnchors(data, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anchors) != 1 || anchors[0].KeyTag != 20326 || anchors[0].Digest != "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D" {
+		t.Fatalf("expected only the current key, got %v", anchors)
+	}
+
+	// Before KSK-2017 was valid only KSK-2010 is
+	anchors, err = parseRootAnchors(data, time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil || len(anchors) != 1 || anchors[0].KeyTag != 19036 {
+		t.Fatalf("expected only the old key, got %v (%v)", anchors, err)
+	}
+
+	invalid := [][]byte{
+		[]byte(`<TrustAnchor><Zone>example.</Zone></TrustAnchor>`),
+		[]byte(`<TrustAnchor><Zone>.</Zone><KeyDigest><KeyTag>1</KeyTag><Algorithm>8</Algorithm><DigestType>2</DigestType><Digest>ABCD</Digest></KeyDigest></TrustAnchor>`),
+		[]byte(`<TrustAnchor><Zone>.</Zone></TrustAnchor>`),
+		[]byte(`not xml`),
+	}
+	for _, data := range invalid {
+		if _, err = parseRootAnchors(data, time.Now()); !errors.Is(err, ErrInvalidAnchors) {
+			t.Fatalf("expected invalid anchors for %s, got %v", data, err)
+		}
+	}
+}
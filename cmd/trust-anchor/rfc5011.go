@@ -0,0 +1,361 @@
+package trust_anchor
+
+import (
+	jsoniter "github.com/json-iterator/go"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"os"
+	"path"
+	file_util "resolver/cmd/file-util"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// addHoldDown is how long a new key has to be published before it is trusted, RFC 5011 section 2.4.1
+	addHoldDown = 30 * 24 * time.Hour
+	// removeHoldDown is how long revoked keys are remembered so they are not added again
+	removeHoldDown = 30 * 24 * time.Hour
+)
+
+// keyState is the state of a key in the RFC 5011 section 4 state table.
+// Keys in the Start and Removed states are not tracked.
+type keyState string
+
+const (
+	stateAddPend keyState = "AddPend"
+	stateValid   keyState = "Valid"
+	stateMissing keyState = "Missing"
+	stateRevoked keyState = "Revoked"
+)
+
+// trackedKey is a root key signing key, stored without the REVOKE flag
+type trackedKey struct {
+	Key       string    `json:"key"`
+	State     keyState  `json:"state"`
+	FirstSeen time.Time `json:"first_seen"`
+	Changed   time.Time `json:"changed"`
+
+	dnskey *dns.DNSKEY
+}
+
+// anchorState is the persisted set of trust anchors, the digests of the imported root-anchors.xml
+// and the keys learnt from the root zone
+type anchorState struct {
+	Digests    []string      `json:"digests"`
+	Keys       []*trackedKey `json:"keys,omitempty"`
+	LastUpdate time.Time     `json:"last_update,omitempty"`
+
+	digests []*dns.DS
+}
+
+var (
+	stateMu sync.Mutex
+	state   *anchorState
+)
+
+// GetStatePath returns the file the trust anchor state is kept in.
+// It defaults to a file next to the cache-domains checkout and can be overridden using TRUST_ANCHOR_STATE.
+func GetStatePath() string {
+	p, ok := os.LookupEnv("TRUST_ANCHOR_STATE")
+	if !ok {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			zap.S().Fatal(err)
+		}
+		p = path.Join(dir, "abs-resolver", "trust-anchors.json")
+	}
+	err := os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	return p
+}
+
+// loadState returns the trust anchor state, read from GetStatePath on first use.
+// Without a usable state the embedded root-anchors.xml is used. stateMu has to be held.
+func loadState() *anchorState {
+	if state != nil {
+		return state
+	}
+	p := GetStatePath()
+	data, err := os.ReadFile(p)
+	if err == nil {
+		state, err = parseState(data)
+		if err == nil {
+			return state
+		}
+		zap.S().Errorf("Invalid trust anchor state %s, using the embedded root anchors (%s)", p, err)
+	} else if !os.IsNotExist(err) {
+		zap.S().Errorf("Failed to read trust anchor state %s, using the embedded root anchors (%s)", p, err)
+	}
+
+	digests, err := parseRootAnchors(embeddedRootAnchors, time.Now())
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	state = newState(digests)
+	return state
+}
+
+func newState(digests []*dns.DS) *anchorState {
+	s := &anchorState{digests: digests}
+	for _, ds := range digests {
+		s.Digests = append(s.Digests, ds.String())
+	}
+	return s
+}
+
+func parseState(data []byte) (*anchorState, error) {
+	var s anchorState
+	err := jsoniter.Unmarshal(data, &s)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range s.Digests {
+		rr, err := dns.NewRR(d)
+		if err != nil {
+			return nil, err
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, ErrInvalidAnchors
+		}
+		s.digests = append(s.digests, ds)
+	}
+	for _, k := range s.Keys {
+		rr, err := dns.NewRR(k.Key)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			return nil, ErrInvalidAnchors
+		}
+		k.dnskey = key
+	}
+	if len(s.trusted()) == 0 {
+		return nil, ErrInvalidAnchors
+	}
+	return &s, nil
+}
+
+func (s *anchorState) save(p string) error {
+	data, err := jsoniter.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return file_util.WriteAtomic(p, data)
+}
+
+// trusted returns the DS records of all trusted keys
+func (s *anchorState) trusted() []*dns.DS {
+	anchors := append([]*dns.DS(nil), s.digests...)
+	for _, k := range s.Keys {
+		if k.State == stateValid || k.State == stateMissing {
+			anchors = append(anchors, k.dnskey.ToDS(dns.SHA256))
+		}
+	}
+	return anchors
+}
+
+// find returns the tracked key equal to key, ignoring the REVOKE flag
+func (s *anchorState) find(key *dns.DNSKEY) *trackedKey {
+	for _, k := range s.Keys {
+		if sameKey(k.dnskey, key) {
+			return k
+		}
+	}
+	return nil
+}
+
+func sameKey(a, b *dns.DNSKEY) bool {
+	return a.Algorithm == b.Algorithm && a.Protocol == b.Protocol &&
+		a.Flags&^dns.REVOKE == b.Flags&^dns.REVOKE &&
+		strings.Join(strings.Fields(a.PublicKey), "") == strings.Join(strings.Fields(b.PublicKey), "")
+}
+
+// withoutRevoke returns a copy of key as it was before being revoked
+func withoutRevoke(key *dns.DNSKEY) *dns.DNSKEY {
+	base := dns.Copy(key).(*dns.DNSKEY)
+	base.Flags &^= dns.REVOKE
+	base.Hdr.Ttl = 0
+	return base
+}
+
+// signedBy returns whether one of sigs over rrset verifies with key
+func signedBy(key *dns.DNSKEY, rrset []dns.RR, sigs []*dns.RRSIG, now time.Time) bool {
+	for _, sig := range sigs {
+		if sig.TypeCovered != dns.TypeDNSKEY || sig.KeyTag != key.KeyTag() || sig.Algorithm != key.Algorithm {
+			continue
+		}
+		if sig.ValidityPeriod(now) && sig.Verify(key, rrset) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// observe applies a root DNSKEY RRset to the state, as in RFC 5011 section 4.
+// Sets not signed by a trusted key are ignored. It returns whether the state changed.
+func (s *anchorState) observe(keys []*dns.DNSKEY, sigs []*dns.RRSIG, now time.Time) bool {
+	rrset := make([]dns.RR, 0, len(keys))
+	for _, key := range keys {
+		rrset = append(rrset, key)
+	}
+
+	trusted := s.trusted()
+	validated := false
+	for _, key := range keys {
+		if key.Flags&dns.REVOKE == 0 && matchesDigest(key, trusted) && signedBy(key, rrset, sigs, now) {
+			validated = true
+			break
+		}
+	}
+	if !validated {
+		zap.S().Warnf("Root DNSKEY set is not signed by a trusted key, trust anchors not updated")
+		return false
+	}
+
+	changed := false
+	seen := make(map[*trackedKey]bool)
+	for _, key := range keys {
+		if key.Flags&dns.SEP == 0 {
+			continue
+		}
+		base := withoutRevoke(key)
+		tracked := s.find(base)
+
+		if key.Flags&dns.REVOKE != 0 {
+			// Only the key itself can revoke it
+			if !signedBy(key, rrset, sigs, now) {
+				continue
+			}
+			if tracked == nil {
+				tracked = &trackedKey{Key: base.String(), FirstSeen: now, dnskey: base}
+				s.Keys = append(s.Keys, tracked)
+			}
+			seen[tracked] = true
+			if tracked.State != stateRevoked {
+				zap.S().Infof("Root key %d has been revoked", base.KeyTag())
+				tracked.State = stateRevoked
+				tracked.Changed = now
+				changed = true
+			}
+			// A revoked key must not stay trusted through the digest it was imported with
+			digests := s.digests[:0]
+			for _, ds := range s.digests {
+				if matchesDigest(base, []*dns.DS{ds}) {
+					changed = true
+					continue
+				}
+				digests = append(digests, ds)
+			}
+			s.digests = digests
+			continue
+		}
+
+		if tracked == nil {
+			tracked = &trackedKey{Key: base.String(), FirstSeen: now, Changed: now, dnskey: base}
+			if matchesDigest(base, s.digests) {
+				tracked.State = stateValid
+			} else {
+				zap.S().Infof("New root key %d, trusting it after the hold-down time", base.KeyTag())
+				tracked.State = stateAddPend
+			}
+			s.Keys = append(s.Keys, tracked)
+			changed = true
+		}
+		seen[tracked] = true
+		switch tracked.State {
+		case stateAddPend:
+			if now.Sub(tracked.FirstSeen) >= addHoldDown {
+				zap.S().Infof("Root key %d is now trusted", base.KeyTag())
+				tracked.State = stateValid
+				tracked.Changed = now
+				changed = true
+			}
+		case stateMissing:
+			tracked.State = stateValid
+			tracked.Changed = now
+			changed = true
+		}
+	}
+
+	keep := s.Keys[:0]
+	for _, k := range s.Keys {
+		if !seen[k] {
+			switch k.State {
+			case stateAddPend:
+				// The key has to be published for the whole hold-down time
+				changed = true
+				continue
+			case stateValid:
+				k.State = stateMissing
+				k.Changed = now
+				changed = true
+			case stateRevoked:
+				if now.Sub(k.Changed) >= removeHoldDown {
+					changed = true
+					continue
+				}
+			}
+		}
+		keep = append(keep, k)
+	}
+	s.Keys = keep
+
+	if changed {
+		s.Digests = s.Digests[:0]
+		for _, ds := range s.digests {
+			s.Digests = append(s.Digests, ds.String())
+		}
+	}
+	s.LastUpdate = now
+	return changed
+}
+
+// GetTrustAnchors returns the DS records of the keys the root zone is currently validated with
+func GetTrustAnchors() []*dns.DS {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return loadState().trusted()
+}
+
+// Observe tracks the keys of a root DNSKEY RRset and its signatures for automated trust anchor updates.
+// The resolver has to pass every root DNSKEY RRset it fetched, at least once per day to follow rollovers.
+func Observe(keys []*dns.DNSKEY, sigs []*dns.RRSIG) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := loadState()
+	s.observe(keys, sigs, time.Now())
+	err := s.save(GetStatePath())
+	if err != nil {
+		zap.S().Errorf("Failed to save trust anchor state (%s)", err)
+	}
+}
+
+// ImportRootAnchors replaces the trust anchors with the currently valid ones of a root-anchors.xml.
+// Tracked keys are forgotten, keys matching the new anchors are learnt on the next update.
+func ImportRootAnchors(p string) error {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	digests, err := parseRootAnchors(data, time.Now())
+	if err != nil {
+		return err
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := newState(digests)
+	err = s.save(GetStatePath())
+	if err != nil {
+		return err
+	}
+	state = s
+	zap.S().Infof("Imported %d root trust anchors from %s", len(digests), p)
+	return nil
+}
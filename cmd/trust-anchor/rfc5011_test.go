@@ -0,0 +1,202 @@
+package trust_anchor
+
+import (
+	"crypto"
+	"github.com/miekg/dns"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type testKey struct {
+	key     *dns.DNSKEY
+	private crypto.Signer
+}
+
+func newTestKey(t *testing.T) *testKey {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 172800},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKey{key: key, private: private.(crypto.Signer)}
+}
+
+func (k *testKey) revoked() *testKey {
+	key := dns.Copy(k.key).(*dns.DNSKEY)
+	key.Flags |= dns.REVOKE
+	return &testKey{key: key, private: k.private}
+}
+
+// signedSet returns the DNSKEY RRset of keys, signed by all of them
+func signedSet(t *testing.T, now time.Time, keys ...*testKey) ([]*dns.DNSKEY, []*dns.RRSIG) {
+	var dnskeys []*dns.DNSKEY
+	var rrset []dns.RR
+	for _, k := range keys {
+		dnskeys = append(dnskeys, k.key)
+		rrset = append(rrset, k.key)
+	}
+	var sigs []*dns.RRSIG
+	for _, k := range keys {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 172800},
+			Algorithm:  k.key.Algorithm,
+			SignerName: ".",
+			KeyTag:     k.key.KeyTag(),
+			Inception:  uint32(now.Add(-time.Hour).Unix()),
+			Expiration: uint32(now.Add(time.Hour).Unix()),
+		}
+		if err := sig.Sign(k.private, rrset); err != nil {
+			t.Fatal(err)
+		}
+		sigs = append(sigs, sig)
+	}
+	return dnskeys, sigs
+}
+
+func trusts(s *anchorState, k *testKey) bool {
+	return matchesDigest(withoutRevoke(k.key), s.trusted())
+}
+
+func TestKeyRollover(t *testing.T) {
+	now := time.Now()
+	oldKey := newTestKey(t)
+	newKey := newTestKey(t)
+	s := newState([]*dns.DS{oldKey.key.ToDS(dns.SHA256)})
+
+	// The imported key is learnt
+	keys, sigs := signedSet(t, now, oldKey)
+	if !s.observe(keys, sigs, now) || s.find(oldKey.key).State != stateValid {
+		t.Fatal("imported key not tracked as valid")
+	}
+
+	// A set signed by an untrusted key is ignored
+	keys, sigs = signedSet(t, now, newKey)
+	if s.observe(keys, sigs, now) || s.find(newKey.key) != nil {
+		t.Fatal("untrusted key set accepted")
+	}
+
+	// A new key is only trusted after the hold-down time
+	keys, sigs = signedSet(t, now, oldKey, newKey)
+	s.observe(keys, sigs, now)
+	if s.find(newKey.key).State != stateAddPend || trusts(s, newKey) {
+		t.Fatal("new key trusted before the hold-down time")
+	}
+	now = now.Add(addHoldDown / 2)
+	keys, sigs = signedSet(t, now, oldKey, newKey)
+	s.observe(keys, sigs, now)
+	if trusts(s, newKey) {
+		t.Fatal("new key trusted before the hold-down time")
+	}
+	now = now.Add(addHoldDown / 2)
+	keys, sigs = signedSet(t, now, oldKey, newKey)
+	s.observe(keys, sigs, now)
+	if !trusts(s, newKey) {
+		t.Fatal("new key not trusted after the hold-down time")
+	}
+
+	// Revoking the old key removes its trust, the imported digest included
+	keys, sigs = signedSet(t, now, oldKey.revoked(), newKey)
+	s.observe(keys, sigs, now)
+	if s.find(oldKey.key).State != stateRevoked || trusts(s, oldKey) || !trusts(s, newKey) {
+		t.Fatal("revoked key still trusted")
+	}
+
+	// The revoked key is forgotten after the remove hold-down time
+	now = now.Add(removeHoldDown)
+	keys, sigs = signedSet(t, now, newKey)
+	s.observe(keys, sigs, now)
+	if s.find(oldKey.key) != nil || len(s.Keys) != 1 {
+		t.Fatalf("revoked key not removed, got %v", s.Keys)
+	}
+}
+
+func TestPendingKeyWithdrawn(t *testing.T) {
+	now := time.Now()
+	trusted := newTestKey(t)
+	pending := newTestKey(t)
+	s := newState([]*dns.DS{trusted.key.ToDS(dns.SHA256)})
+
+	keys, sigs := signedSet(t, now, trusted, pending)
+	s.observe(keys, sigs, now)
+	if s.find(pending.key) == nil {
+		t.Fatal("new key not tracked")
+	}
+
+	// A key has to be published for the whole hold-down time
+	keys, sigs = signedSet(t, now, trusted)
+	s.observe(keys, sigs, now)
+	if s.find(pending.key) != nil {
+		t.Fatal("withdrawn key still pending")
+	}
+
+	// A revocation needs to be signed by the revoked key itself
+	revoked := trusted.revoked()
+	keys, sigs = signedSet(t, now, trusted)
+	keys = append(keys, revoked.key)
+	s.observe(keys, sigs, now)
+	if s.find(trusted.key).State != stateValid {
+		t.Fatal("key revoked without its signature")
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	p := path.Join(t.TempDir(), "trust-anchors.json")
+	now := time.Now()
+	key := newTestKey(t)
+	pending := newTestKey(t)
+	s := newState([]*dns.DS{key.key.ToDS(dns.SHA256)})
+	keys, sigs := signedSet(t, now, key, pending)
+	s.observe(keys, sigs, now)
+	if err := s.save(p); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := parseState(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !trusts(loaded, key) || trusts(loaded, pending) || loaded.find(pending.key).State != stateAddPend {
+		t.Fatal("state not restored")
+	}
+	if !loaded.find(pending.key).FirstSeen.Equal(s.find(pending.key).FirstSeen) {
+		t.Fatal("hold-down timer not restored")
+	}
+}
+
+func TestImportRootAnchors(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TRUST_ANCHOR_STATE", path.Join(dir, "trust-anchors.json"))
+	defer func() {
+		state = nil
+	}()
+
+	xmlPath := path.Join(dir, "root-anchors.xml")
+	if err := os.WriteFile(xmlPath, embeddedRootAnchors, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportRootAnchors(xmlPath); err != nil {
+		t.Fatal(err)
+	}
+	state = nil
+	if anchors := GetTrustAnchors(); len(anchors) != 2 {
+		t.Fatalf("expected the imported anchors, got %v", anchors)
+	}
+
+	if err := os.WriteFile(xmlPath, []byte("<TrustAnchor><Zone>.</Zone></TrustAnchor>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportRootAnchors(xmlPath); err == nil {
+		t.Fatal("import without anchors succeeded")
+	}
+}
@@ -6,10 +6,8 @@ require (
 	github.com/go-git/go-git/v5 v5.4.2
 	github.com/json-iterator/go v1.1.12
 	github.com/miekg/dns v1.1.50
-	github.com/patrickmn/go-cache v2.1.0+incompatible
 	go.elastic.co/ecszap v1.0.1
 	go.uber.org/zap v1.23.0
-	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985
 )
 
 require (
@@ -33,6 +31,7 @@ require (
 	go.uber.org/multierr v1.6.0 // indirect
 	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b // indirect
 	golang.org/x/mod v0.4.2 // indirect
+	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985 // indirect
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
 	golang.org/x/tools v0.1.6-0.20210726203631-07bc1bf47fb2 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect